@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,10 +21,40 @@ func packageCacheDir(userCacheDir, absPackagePath string) string {
 	return filepath.Join(userCacheDir, "gr", "exe", absPackagePath)
 }
 
+//
+// Checksums do not depend on the location of the package, so the executables are stored once, by checksum,
+// and linked into the directories of all packages that have them. This way checkouts of the same code in
+// several places share a single build.
+//
+// Entries in package directories are hard links, so that removing them from the store does not break
+// running them, and cacheCleanup works the same way for linked and copied entries.
+//
+
+func storeDir(userCacheDir string) string {
+	return filepath.Join(userCacheDir, "gr", "store")
+}
+
+func storeFile(userCacheDir, checksum string) string {
+	return filepath.Join(storeDir(userCacheDir), checksum)
+}
+
+func storeInfoFile(userCacheDir, checksum string) string {
+	return storeFile(userCacheDir, checksum) + ".json"
+}
+
+// storeInfo describes how a build in the store has been made. Builds made by older versions of 'gr' only have
+// the package, flags and environment recorded.
+type storeInfo struct {
+	Package string `json:"package"` // absolute path of the package it has been built from first
+	keyInputs
+}
+
 const keepCacheEntriesOnCleanup = 2
 
+// cacheCleanup removes all but the keep most recent entries of a package.
+//
 // This function should be called with a package lock held
-func cacheCleanup(packageCachePath string) error {
+func cacheCleanup(packageCachePath string, keep int) error {
 	//
 	// While it might be argued that cleaning up cache should not fail, ignoring errors may cause the cache
 	// to fill up, and cause problems with disk space, especially in CI.
@@ -45,6 +78,9 @@ func cacheCleanup(packageCachePath string) error {
 	var cacheContents []cacheEntry
 
 	for _, de := range des {
+		if !de.Type().IsRegular() { // Cache directories of nested packages
+			continue
+		}
 		fi, err := de.Info()
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -63,8 +99,8 @@ func cacheCleanup(packageCachePath string) error {
 		return cacheContents[i].mtime.Before(cacheContents[j].mtime)
 	})
 
-	for i := range len(cacheContents) - keepCacheEntriesOnCleanup {
-		err := os.Remove(filepath.Join(packageCachePath, cacheContents[i].fileName))
+	for i := range len(cacheContents) - keep {
+		_, err := removeUnlessHeld(filepath.Join(packageCachePath, cacheContents[i].fileName))
 		if err != nil {
 			if os.IsNotExist(err) {
 				continue
@@ -76,21 +112,21 @@ func cacheCleanup(packageCachePath string) error {
 	return nil
 }
 
+// build builds the package in dir, or, if packagePath is not empty, the package given by import path from dir.
+//
 // This function expects
 // - output path to be absolute
 // - paths in compiler flags/env, if any, to be absolute
 // so that it can cd to the package directory and build from there.
 //
 // Otherwise cross-module tool running is not going to work.
-func build(packagePath string, absOutputPath string, compilerFlags []string, compilerEnv map[string]string) bool {
-	goBin := "go"
-	if bin, found := os.LookupEnv("GO"); found {
-		goBin = bin
-	}
-
-	compileCmd := exec.Command(goBin, "build", "-trimpath", "-buildvcs=false", "-o", absOutputPath)
+func build(dir string, packagePath string, absOutputPath string, compilerFlags []string, compilerEnv map[string]string) bool {
+	compileCmd := exec.Command(goBinary(), "build", "-trimpath", "-buildvcs=false", "-o", absOutputPath)
 	compileCmd.Args = append(compileCmd.Args, compilerFlags...)
-	compileCmd.Dir = packagePath
+	if packagePath != "" {
+		compileCmd.Args = append(compileCmd.Args, packagePath)
+	}
+	compileCmd.Dir = dir
 	if len(compilerEnv) > 0 {
 		compileCmd.Env = os.Environ()
 		for k, v := range compilerEnv {
@@ -130,25 +166,205 @@ func openPackageCacheDir(absPackageCacheDir string) (*os.File, error) {
 	return fh, nil
 }
 
+// lockPackageCacheDir creates the package cache directory if needed and locks it
+func lockPackageCacheDir(absPackageCacheDir string) (*os.File, error) {
+	for {
+		fh, err := openPackageCacheDir(absPackageCacheDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := syscall.Flock(int(fh.Fd()), syscall.LOCK_EX); err != nil {
+			fh.Close()
+			return nil, err
+		}
+
+		// Garbage collection removes empty package directories with the lock held, so the directory might have
+		// been removed while this process was waiting for the lock
+		lockedFI, err := fh.Stat()
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		currentFI, err := os.Stat(absPackageCacheDir)
+		if err == nil && os.SameFile(lockedFI, currentFI) {
+			return fh, nil
+		}
+		fh.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// tryLockPackageCacheDir locks an existing package cache directory, or returns nil if it is locked already
+func tryLockPackageCacheDir(absPackageCacheDir string) (*os.File, error) {
+	fh, err := os.Open(absPackageCacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fh.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return fh, nil
+}
+
+// removeUnlessHeld removes a cache entry unless somebody holds a shared lock on it, see 'gr -which'
+func removeUnlessHeld(fileName string) (retRemoved bool, _ error) {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+
+	// The lock is held until the file is removed, so that nobody locks the file that is being removed
+	if err := syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := os.Remove(fileName); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeEmptyDir removes a package cache directory unless it contains entries or cache directories of
+// nested packages. It should be called with the directory lock held: 'gr' waiting for the lock notices
+// the removal, see lockPackageCacheDir.
+func removeEmptyDir(dir string) error {
+	err := os.Remove(dir)
+	if err == nil || os.IsNotExist(err) || errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+		return nil
+	}
+	return err
+}
+
+// buildFunc builds the executable of a package to absOutputPath. If the build fails, the go command explains why,
+// so false is returned instead of an error.
+type buildFunc func(absOutputPath string) (retBuilt bool, _ error)
+
 // This function is only called if optimistic exec() failed, so it's not on a fast path
-func updateCache(userCacheDir, absPackagePath, sourceChecksum string, compilerFlags []string, compilerEnv map[string]string) (retUpdated bool, _ error) {
+func updateCache(userCacheDir, absPackagePath, sourceChecksum string, inputs keyInputs, build buildFunc) (retUpdated bool, _ error) {
 	// Lock the package directory
 	p := packageCacheDir(userCacheDir, absPackagePath)
 
-	fh, err := openPackageCacheDir(p)
+	fh, err := lockPackageCacheDir(p)
 	if err != nil {
 		return false, fmt.Errorf("failed to update exe cache for %q: %w", absPackagePath, err)
 	}
+	// There is no need to explicitly remove lock, closing file descriptor removes it.
 	defer fh.Close()
 
-	if err := syscall.Flock(int(fh.Fd()), syscall.LOCK_EX); err != nil {
+	if err := cacheCleanup(p, keepCacheEntriesOnCleanup); err != nil {
 		return false, fmt.Errorf("failed to update exe cache for %q: %w", absPackagePath, err)
 	}
-	// There is no need to explicitly remove lock, closing file descriptor in the 'defer' above removes it.
 
-	if err := cacheCleanup(p); err != nil {
-		return false, fmt.Errorf("failed to update exe cache for %q: %w", absPackagePath, err)
+	stored := storeFile(userCacheDir, sourceChecksum)
+	for {
+		// Marking the build as used also protects it from garbage collection
+		now := time.Now()
+		if err := os.Chtimes(stored, now, now); err != nil {
+			if !os.IsNotExist(err) {
+				return false, fmt.Errorf("failed to update exe cache for %q: %w", absPackagePath, err)
+			}
+
+			// Not built from any location yet
+			built, err := buildToStore(userCacheDir, absPackagePath, sourceChecksum, inputs, build)
+			if err != nil {
+				return false, fmt.Errorf("failed to update exe cache for %q: %w", absPackagePath, err)
+			}
+			if !built {
+				return false, nil
+			}
+		}
+
+		err := linkFromStore(stored, packageCacheFile(userCacheDir, absPackagePath, sourceChecksum))
+		if os.IsNotExist(err) { // Garbage collection has just removed it
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to update exe cache for %q: %w", absPackagePath, err)
+		}
+		return true, nil
+	}
+}
+
+// buildToStore builds into a temporary file and renames it, as another 'gr' might be building the same
+// checksum from another location at the same time
+func buildToStore(userCacheDir, absPackagePath, sourceChecksum string, inputs keyInputs, build buildFunc) (retBuilt bool, _ error) {
+	if err := os.MkdirAll(storeDir(userCacheDir), 0o755); err != nil {
+		return false, err
 	}
 
-	return build(absPackagePath, packageCacheFile(userCacheDir, absPackagePath, sourceChecksum), compilerFlags, compilerEnv), nil
+	stored := storeFile(userCacheDir, sourceChecksum)
+	tmp, err := os.CreateTemp(storeDir(userCacheDir), filepath.Base(stored)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name()) // No-op after successful rename
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+
+	if built, err := build(tmp.Name()); err != nil || !built {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), stored); err != nil {
+		return false, err
+	}
+
+	info, err := json.Marshal(storeInfo{Package: absPackagePath, keyInputs: inputs})
+	if err != nil {
+		panic(fmt.Errorf("internal error: store information is not marshalable: %w", err))
+	}
+	return true, writeFileAtomically(storeInfoFile(userCacheDir, sourceChecksum), info)
+}
+
+func linkFromStore(stored, packageCacheFile string) error {
+	err := os.Link(stored, packageCacheFile)
+	if err == nil || os.IsExist(err) {
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return err
+	}
+	// Hard links might be unsupported by the filesystem
+	return copyFile(stored, packageCacheFile)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after successful rename
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
 }
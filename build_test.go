@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func TestCacheCleanup(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "oldest", 10, gcTestNow.Add(-3*time.Hour), "/a")
+	mustAddTestBuild(cacheDir, "older", 10, gcTestNow.Add(-2*time.Hour), "/a")
+	mustAddTestBuild(cacheDir, "newer", 10, gcTestNow.Add(-time.Hour), "/a")
+	mustAddTestBuild(cacheDir, "newest", 10, gcTestNow, "/a", "/a/nested")
+
+	must.OK(cacheCleanup(packageCacheDir(cacheDir, "/a"), 2))
+
+	assert.False(t, exists(packageCacheFile(cacheDir, "/a", "oldest")))
+	assert.False(t, exists(packageCacheFile(cacheDir, "/a", "older")))
+	assert.True(t, exists(packageCacheFile(cacheDir, "/a", "newer")))
+	assert.True(t, exists(packageCacheFile(cacheDir, "/a", "newest")))
+	assert.True(t, exists(packageCacheFile(cacheDir, "/a/nested", "newest")))
+}
+
+func TestCacheCleanupKeepsHeldEntries(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "held", 10, gcTestNow.Add(-time.Hour), "/a")
+	mustAddTestBuild(cacheDir, "other", 10, gcTestNow, "/a")
+
+	fh := must.OK1(os.Open(packageCacheFile(cacheDir, "/a", "held")))
+	defer fh.Close()
+	must.OK(syscall.Flock(int(fh.Fd()), syscall.LOCK_SH))
+
+	must.OK(cacheCleanup(packageCacheDir(cacheDir, "/a"), 0))
+
+	assert.True(t, exists(packageCacheFile(cacheDir, "/a", "held")))
+	assert.False(t, exists(packageCacheFile(cacheDir, "/a", "other")))
+}
@@ -0,0 +1,322 @@
+//nolint:revive,errorlint,gocritic // This file contains code copy-pasted from Go source
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	gobuild "go/build"
+	"io"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//
+// Decide which files in package directory are a part of the build, the same way 'go build' does:
+// by looking at GOOS/GOARCH file name suffixes and //go:build constraints. The matching is done by go/build,
+// configured for the target platform and the toolchain selected for the build: release tags and goexperiment
+// tags enabled by default differ between toolchains.
+//
+// Files that are excluded from the build do not contribute to the checksum and their imports are not followed.
+//
+
+type buildContext struct {
+	ctxt gobuild.Context
+}
+
+// toolchainTags are the tags set by the toolchain itself, regardless of the environment
+type toolchainTags struct {
+	ReleaseTags    []string `json:"release_tags"`
+	ExperimentTags []string `json:"experiment_tags"` // goexperiment.* tags enabled by default
+}
+
+func newBuildContext(compilerFlags []string, compilerEnv map[string]string, tags toolchainTags) *buildContext {
+	bc := &buildContext{
+		ctxt: gobuild.Context{
+			GOOS:        envOr(compilerEnv, "GOOS", runtime.GOOS),
+			GOARCH:      envOr(compilerEnv, "GOARCH", runtime.GOARCH),
+			Compiler:    "gc",
+			ReleaseTags: tags.ReleaseTags,
+		},
+	}
+
+	switch compilerEnv["CGO_ENABLED"] {
+	case "1":
+		bc.ctxt.CgoEnabled = true
+	case "0":
+		bc.ctxt.CgoEnabled = false
+	default:
+		// Cross-compilation disables cgo by default
+		bc.ctxt.CgoEnabled = gobuild.Default.CgoEnabled && bc.ctxt.GOOS == runtime.GOOS && bc.ctxt.GOARCH == runtime.GOARCH
+	}
+
+	if buildTags, found := goFlag(compilerFlags, compilerEnv, "tags"); found {
+		// Old-style space-separated tags are still accepted by 'go build'
+		bc.ctxt.BuildTags = strings.FieldsFunc(buildTags, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+
+	bc.ctxt.ToolTags = append(experimentTags(tags.ExperimentTags, compilerEnv["GOEXPERIMENT"]),
+		gogoarchTags(bc.ctxt.GOARCH, compilerEnv)...)
+
+	return bc
+}
+
+// matchFile tells if the file is a part of the build, given its name and the header: leading comments, and for
+// .go files the package clause and imports too
+func (bc *buildContext) matchFile(filename string, header []byte) (bool, error) {
+	ctxt := bc.ctxt
+	ctxt.OpenFile = func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(header)), nil
+	}
+	return ctxt.MatchFile(filepath.Dir(filename), filepath.Base(filename))
+}
+
+// goodOSArchFile tells if GOOS/GOARCH suffixes of the file name, if any, match the build
+func (bc *buildContext) goodOSArchFile(name string) bool {
+	match, _ := bc.matchFile(name, nil) // Empty header has no constraints
+	return match
+}
+
+// matchAuto interprets text as either a +build or //go:build expression (whichever works), reporting whether
+// the expression matches the build context. This is how conditions of #cgo lines are evaluated.
+func (bc *buildContext) matchAuto(text string) bool {
+	if strings.ContainsAny(text, "&|()") {
+		text = "//go:build " + text
+	} else {
+		text = "// +build " + text
+	}
+	match, err := bc.matchFile("cgo.go", []byte(text+"\n\npackage p\n"))
+	return err == nil && match
+}
+
+func envOr(env map[string]string, name string, def string) string {
+	if val := env[name]; val != "" {
+		return val
+	}
+	return def
+}
+
+// experimentTags returns goexperiment.* tags enabled by default in the toolchain, adjusted by GOEXPERIMENT
+func experimentTags(defaults []string, goexperiment string) []string {
+	list := slices.Clone(defaults)
+
+	for _, exp := range strings.Split(goexperiment, ",") {
+		switch {
+		case exp == "" || exp == "none":
+		case strings.HasPrefix(exp, "no"):
+			list = slices.DeleteFunc(list, func(tag string) bool { return tag == "goexperiment."+exp[2:] })
+		case !slices.Contains(list, "goexperiment."+exp):
+			list = append(list, "goexperiment."+exp)
+		}
+	}
+	return list
+}
+
+// Adapted from go/src/internal/buildcfg/cfg.go
+
+func gogoarchTags(goarch string, compilerEnv map[string]string) []string {
+	level := func(env string, prefix string, def int) int {
+		v, _, _ := strings.Cut(envOr(compilerEnv, env, ""), ",")
+		if n, err := strconv.Atoi(strings.TrimPrefix(v, prefix)); err == nil {
+			return n
+		}
+		return def
+	}
+
+	switch goarch {
+	case "386":
+		return []string{goarch + "." + envOr(compilerEnv, "GO386", "sse2")}
+	case "amd64":
+		var list []string
+		for i := 1; i <= level("GOAMD64", "v", 1); i++ {
+			list = append(list, fmt.Sprintf("%s.v%d", goarch, i))
+		}
+		return list
+	case "arm":
+		var list []string
+		for i := 5; i <= level("GOARM", "", 7); i++ {
+			list = append(list, fmt.Sprintf("%s.%d", goarch, i))
+		}
+		return list
+	case "arm64":
+		version, _, _ := strings.Cut(envOr(compilerEnv, "GOARM64", "v8.0"), ",")
+		if len(version) != 4 || version[0] != 'v' || version[2] != '.' {
+			version = "v8.0"
+		}
+		major := int(version[1] - '0')
+		minor := int(version[3] - '0')
+		var list []string
+		for i := 0; i <= minor; i++ {
+			list = append(list, fmt.Sprintf("%s.v%d.%d", goarch, major, i))
+		}
+		// ARM64 v9.x also includes support of v8.x+5 (i.e. v9.1 includes v8.(1+5) = v8.6).
+		if major == 9 {
+			for i := 0; i <= minor+5 && i <= 9; i++ {
+				list = append(list, fmt.Sprintf("%s.v%d.%d", goarch, 8, i))
+			}
+		}
+		return list
+	case "mips", "mipsle":
+		return []string{goarch + "." + envOr(compilerEnv, "GOMIPS", "hardfloat")}
+	case "mips64", "mips64le":
+		return []string{goarch + "." + envOr(compilerEnv, "GOMIPS64", "hardfloat")}
+	case "ppc64", "ppc64le":
+		var list []string
+		for i := 8; i <= level("GOPPC64", "power", 8); i++ {
+			list = append(list, fmt.Sprintf("%s.power%d", goarch, i))
+		}
+		return list
+	case "riscv64":
+		list := []string{goarch + "." + "rva20u64"}
+		if l := level("GORISCV64", "rva", 20); l >= 22 {
+			list = append(list, goarch+"."+"rva22u64")
+			if l >= 23 {
+				list = append(list, goarch+"."+"rva23u64")
+			}
+		}
+		return list
+	case "wasm":
+		return []string{goarch + ".satconv", goarch + ".signext"}
+	}
+	return nil
+}
+
+// Taken from go/src/go/build/build.go
+
+// expandSrcDir expands any occurrence of ${SRCDIR}, making sure
+// the result is safe for the shell.
+func expandSrcDir(str string, srcdir string) (string, bool) {
+	// "\" delimited paths cause safeCgoName to fail
+	// so convert native paths with a different delimiter
+	// to "/" before starting (eg: on windows).
+	srcdir = filepath.ToSlash(srcdir)
+
+	chunks := strings.Split(str, "${SRCDIR}")
+	if len(chunks) < 2 {
+		return str, safeCgoName(str)
+	}
+	ok := true
+	for _, chunk := range chunks {
+		ok = ok && (chunk == "" || safeCgoName(chunk))
+	}
+	ok = ok && (srcdir == "" || safeCgoName(srcdir))
+	res := strings.Join(chunks, srcdir)
+	return res, ok && res != ""
+}
+
+// makePathsAbsolute looks for compiler options that take paths and
+// makes them absolute. We do this because through the 1.8 release we
+// ran the compiler in the package directory, so any relative -I or -L
+// options would be relative to that directory. In 1.9 we changed to
+// running the compiler in the build directory, to get consistent
+// build results (issue #19964). To keep builds working, we change any
+// relative -I or -L options to be absolute.
+//
+// Using filepath.IsAbs and filepath.Join here means the results will be
+// different on different systems, but that's OK: -I and -L options are
+// inherently system-dependent.
+func makePathsAbsolute(args []string, srcDir string) {
+	nextPath := false
+	for i, arg := range args {
+		if nextPath {
+			if !filepath.IsAbs(arg) {
+				args[i] = filepath.Join(srcDir, arg)
+			}
+			nextPath = false
+		} else if strings.HasPrefix(arg, "-I") || strings.HasPrefix(arg, "-L") {
+			if len(arg) == 2 {
+				nextPath = true
+			} else {
+				if !filepath.IsAbs(arg[2:]) {
+					args[i] = arg[:2] + filepath.Join(srcDir, arg[2:])
+				}
+			}
+		}
+	}
+}
+
+// NOTE: $ is not safe for the shell, but it is allowed here because of linker options like -Wl,$ORIGIN.
+// We never pass these arguments to a shell (just to programs we construct argv for), so this should be okay.
+// See golang.org/issue/6038.
+// The @ is for OS X. See golang.org/issue/13720.
+// The % is for Jenkins. See golang.org/issue/16959.
+// The ! is because module paths may use them. See golang.org/issue/26716.
+// The ~ and ^ are for sr.ht. See golang.org/issue/32260.
+const safeString = "+-.,/0123456789=ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz:$@%! ~^"
+
+func safeCgoName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < utf8.RuneSelf && strings.IndexByte(safeString, c) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// splitQuoted splits the string s around each instance of one or more consecutive
+// white space characters while taking into account quotes and escaping, and
+// returns an array of substrings of s or an empty list if s contains only white space.
+// Single quotes and double quotes are recognized to prevent splitting within the
+// quoted region, and are removed from the resulting substrings. If a quote in s
+// isn't closed err will be set and r will have the unclosed argument as the
+// last element. The backslash is used for escaping.
+//
+// For example, the following string:
+//
+//	a b:"c d" 'e''f'  "g\""
+//
+// Would be parsed as:
+//
+//	[]string{"a", "b:c d", "ef", `g"`}
+func splitQuoted(s string) (r []string, err error) {
+	var args []string
+	arg := make([]rune, len(s))
+	escaped := false
+	quoted := false
+	quote := '\x00'
+	i := 0
+	for _, rune := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case rune == '\\':
+			escaped = true
+			continue
+		case quote != '\x00':
+			if rune == quote {
+				quote = '\x00'
+				continue
+			}
+		case rune == '"' || rune == '\'':
+			quoted = true
+			quote = rune
+			continue
+		case unicode.IsSpace(rune):
+			if quoted || i > 0 {
+				quoted = false
+				args = append(args, string(arg[:i]))
+				i = 0
+			}
+			continue
+		}
+		arg[i] = rune
+		i++
+	}
+	if quoted || i > 0 {
+		args = append(args, string(arg[:i]))
+	}
+	if quote != 0 {
+		err = errors.New("unclosed quote")
+	} else if escaped {
+		err = errors.New("unfinished escaping")
+	}
+	return args, err
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+func cacheUsage(out io.Writer) {
+	fmt.Fprintln(out, `Usage: gr -cache <command> [arguments]
+
+Commands:
+  ls [-json]             list cached builds
+  rm <pkg>...            remove cached builds of packages
+  clean                  remove everything from the cache
+  path [-json] [<pkg>]   print the location of the cache, or of the cached builds of a package`)
+}
+
+type cacheEntryInfo struct {
+	Checksum string    `json:"checksum"`
+	Size     int64     `json:"size"`
+	LastUse  time.Time `json:"last_use"`
+	Flags    []string  `json:"flags"`
+}
+
+type cachePackageInfo struct {
+	Package string           `json:"package"`
+	Entries []cacheEntryInfo `json:"entries"` // most recently used first
+}
+
+func cacheCommand(args []string) int {
+	if len(args) == 0 {
+		cacheUsage(os.Stderr)
+		return 2
+	}
+
+	cacheDir, err := userCacheDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't run: %v\n", err)
+		return 255
+	}
+
+	switch args[0] {
+	case "ls":
+		return cacheLsCommand(cacheDir, args[1:])
+	case "rm":
+		return cacheRmCommand(cacheDir, args[1:])
+	case "clean":
+		return cacheCleanCommand(cacheDir, args[1:])
+	case "path":
+		return cachePathCommand(cacheDir, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "gr -cache: unknown command %q\n", args[0])
+		cacheUsage(os.Stderr)
+		return 2
+	}
+}
+
+func newCacheFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("gr -cache "+name, flag.ContinueOnError)
+	flags.Usage = func() { cacheUsage(flags.Output()) }
+	return flags
+}
+
+func cacheLsCommand(cacheDir string, args []string) int {
+	flags := newCacheFlagSet("ls")
+	jsonOutput := flags.Bool("json", false, "print JSON")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	packages, err := listCache(cacheDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: failed to list cache: %v\n", err)
+		return 255
+	}
+
+	if *jsonOutput {
+		return printJSON(packages)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tBUILD\tSIZE\tLAST USE\tFLAGS")
+	for _, p := range packages {
+		for _, e := range p.Entries {
+			fmt.Fprintf(tw, "%s\t%.12s\t%s\t%s\t%s\n", p.Package, e.Checksum, formatSize(e.Size),
+				e.LastUse.Local().Format("2006-01-02 15:04"), strings.Join(e.Flags, " "))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "gr: failed to list cache: %v\n", err)
+		return 255
+	}
+	return 0
+}
+
+func cacheRmCommand(cacheDir string, args []string) int {
+	flags := newCacheFlagSet("rm")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	for _, packagePath := range flags.Args() {
+		absPackagePath, err := cachedPackageDir(packagePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gr: can't find package %q: %v\n", packagePath, err)
+			return 255
+		}
+		if err := removePackageCache(cacheDir, absPackagePath); err != nil {
+			fmt.Fprintf(os.Stderr, "gr: failed to remove cached builds of %q: %v\n", packagePath, err)
+			return 255
+		}
+	}
+	return 0
+}
+
+func cacheCleanCommand(cacheDir string, args []string) int {
+	flags := newCacheFlagSet("clean")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	if err := cleanCache(cacheDir); err != nil {
+		fmt.Fprintf(os.Stderr, "gr: failed to clean cache: %v\n", err)
+		return 255
+	}
+	return 0
+}
+
+func cachePathCommand(cacheDir string, args []string) int {
+	flags := newCacheFlagSet("path")
+	jsonOutput := flags.Bool("json", false, "print JSON")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	path := filepath.Join(cacheDir, "gr")
+	if flags.NArg() == 1 {
+		absPackagePath, err := cachedPackageDir(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gr: can't find package %q: %v\n", flags.Arg(0), err)
+			return 255
+		}
+		path = packageCacheDir(cacheDir, absPackagePath)
+	}
+
+	if *jsonOutput {
+		return printJSON(struct {
+			Path string `json:"path"`
+		}{path})
+	}
+	fmt.Println(path)
+	return 0
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// cachedPackageDir resolves a package given to a cache command. Build flags are not known, but they do not
+// affect the resolution, unless -mod is given.
+func cachedPackageDir(packagePath string) (string, error) {
+	compilerEnv, err := compilerEnvironment()
+	if err != nil {
+		return "", err
+	}
+
+	// Remote packages are cached by path and exact version
+	if isRemotePackage(packagePath) {
+		p, v, err := splitRemotePackage(packagePath)
+		if err != nil {
+			return "", err
+		}
+		if module.CanonicalVersion(v) != v {
+			if v, err = resolveRemoteVersion(p, v, compilerEnv); err != nil {
+				return "", err
+			}
+		}
+		return p + "@" + v, nil
+	}
+
+	return resolvePackageDir(packagePath, nil, compilerEnv)
+}
+
+func printJSON(v any) int {
+	if err := writeJSON(os.Stdout, v); err != nil {
+		fmt.Fprintf(os.Stderr, "gr: failed to print JSON: %v\n", err)
+		return 255
+	}
+	return 0
+}
+
+func formatSize(size int64) string {
+	if size < 1<<10 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, unit := float64(size)/(1<<10), "KiB"
+	for _, u := range []string{"MiB", "GiB", "TiB"} {
+		if value < 1<<10 {
+			break
+		}
+		value, unit = value/(1<<10), u
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
+// listCache returns cached builds, sorted by package
+func listCache(userCacheDir string) ([]cachePackageInfo, error) {
+	exeDir := packageCacheDir(userCacheDir, "")
+
+	packages := map[string]*cachePackageInfo{}
+	err := filepath.WalkDir(exeDir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Temporary files are entries being added
+		if !de.Type().IsRegular() || strings.HasSuffix(de.Name(), ".tmp") {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		entry := cacheEntryInfo{
+			Checksum: de.Name(),
+			Size:     fi.Size(),
+			LastUse:  fi.ModTime(),
+			Flags:    []string{},
+		}
+		// Information is missing for builds made by older versions of 'gr'
+		if contents, err := os.ReadFile(storeInfoFile(userCacheDir, de.Name())); err == nil {
+			var info storeInfo
+			if json.Unmarshal(contents, &info) == nil && info.Flags != nil {
+				entry.Flags = info.Flags
+			}
+		}
+
+		absPackagePath := strings.TrimPrefix(filepath.Dir(path), exeDir)
+		// Remote packages are cached by path@version instead of directory
+		if p := strings.TrimPrefix(absPackagePath, "/"); isCachedRemotePackage(p) {
+			absPackagePath = p
+		}
+		if packages[absPackagePath] == nil {
+			packages[absPackagePath] = &cachePackageInfo{Package: absPackagePath}
+		}
+		packages[absPackagePath].Entries = append(packages[absPackagePath].Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := []cachePackageInfo{}
+	for _, p := range packages {
+		slices.SortFunc(p.Entries, func(a, b cacheEntryInfo) int { return b.LastUse.Compare(a.LastUse) })
+		out = append(out, *p)
+	}
+	slices.SortFunc(out, func(a, b cachePackageInfo) int { return strings.Compare(a.Package, b.Package) })
+	return out, nil
+}
+
+// removePackageCache removes cached builds of a package, and their copies in the store, so that the package
+// is rebuilt on the next run
+func removePackageCache(userCacheDir, absPackagePath string) error {
+	p := packageCacheDir(userCacheDir, absPackagePath)
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	fh, err := lockPackageCacheDir(p)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	des, err := os.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	if err := cacheCleanup(p, 0); err != nil {
+		return err
+	}
+	for _, de := range des {
+		if de.Type().IsRegular() {
+			if err := removeFromStore(userCacheDir, de.Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return removeEmptyDir(p)
+}
+
+// removeFromStore removes a build from the store, unless it is held by a user of 'gr -which'
+func removeFromStore(userCacheDir, checksum string) error {
+	removed, err := removeUnlessHeld(storeFile(userCacheDir, checksum))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !removed {
+		return nil
+	}
+	if err := os.Remove(storeInfoFile(userCacheDir, checksum)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cleanCache removes everything from the cache, except for the builds in progress
+func cleanCache(userCacheDir string) error {
+	exeDir := packageCacheDir(userCacheDir, "")
+	var dirs []string
+	err := filepath.WalkDir(exeDir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if de.IsDir() && path != exeDir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Children first, so that the directories are empty by the time they are removed
+	slices.Sort(dirs)
+	for _, dir := range slices.Backward(dirs) {
+		fh, err := lockPackageCacheDir(dir)
+		if err != nil {
+			return err
+		}
+		err = cacheCleanup(dir, 0)
+		if err == nil {
+			err = removeEmptyDir(dir)
+		}
+		fh.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	des, err := os.ReadDir(storeDir(userCacheDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, de := range des {
+		// Temporary files are builds in progress, and information files are removed along with their builds
+		if strings.HasSuffix(de.Name(), ".tmp") || strings.HasSuffix(de.Name(), ".json") {
+			continue
+		}
+		if err := removeFromStore(userCacheDir, de.Name()); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []string{hashIndexDir(userCacheDir), toolchainMemoDir(userCacheDir)} {
+		des, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, de := range des {
+			if strings.HasSuffix(de.Name(), ".tmp") {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, de.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
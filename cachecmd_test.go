@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func TestListCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "older", 10, gcTestNow.Add(-time.Hour), "/a", "/a/b")
+	mustAddTestBuild(cacheDir, "newer", 20, gcTestNow, "/a")
+	must.OK(os.WriteFile(storeInfoFile(cacheDir, "newer"), []byte(`{"flags":["-tags","extra"]}`), 0o644))
+
+	assert.Equal(t, []cachePackageInfo{
+		{Package: "/a", Entries: []cacheEntryInfo{
+			{Checksum: "newer", Size: 20, LastUse: gcTestNow, Flags: []string{"-tags", "extra"}},
+			{Checksum: "older", Size: 10, LastUse: gcTestNow.Add(-time.Hour), Flags: []string{}},
+		}},
+		{Package: "/a/b", Entries: []cacheEntryInfo{
+			{Checksum: "older", Size: 10, LastUse: gcTestNow.Add(-time.Hour), Flags: []string{}},
+		}},
+	}, normalizeCacheTimes(must.OK1(listCache(cacheDir))))
+}
+
+// normalizeCacheTimes drops the location from times read from the filesystem, for comparison
+func normalizeCacheTimes(packages []cachePackageInfo) []cachePackageInfo {
+	for _, p := range packages {
+		for i := range p.Entries {
+			p.Entries[i].LastUse = p.Entries[i].LastUse.UTC()
+		}
+	}
+	return packages
+}
+
+func TestRemovePackageCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "shared", 10, gcTestNow, "/a", "/a/b")
+	mustAddTestBuild(cacheDir, "own", 10, gcTestNow, "/a")
+	mustAddTestBuild(cacheDir, "other", 10, gcTestNow, "/c")
+
+	must.OK(removePackageCache(cacheDir, "/a"))
+
+	// Cache directories of nested packages are kept
+	assert.False(t, exists(packageCacheFile(cacheDir, "/a", "shared")))
+	assert.False(t, exists(packageCacheFile(cacheDir, "/a", "own")))
+	assert.True(t, exists(packageCacheFile(cacheDir, "/a/b", "shared")))
+	assert.False(t, exists(storeFile(cacheDir, "own")))
+	assert.False(t, exists(storeFile(cacheDir, "shared")))
+	assert.True(t, exists(storeFile(cacheDir, "other")))
+
+	must.OK(removePackageCache(cacheDir, "/a/b"))
+	must.OK(removePackageCache(cacheDir, "/nonexistent"))
+	assert.False(t, exists(packageCacheDir(cacheDir, "/a/b")))
+}
+
+func TestCleanCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "one", 10, gcTestNow, "/a", "/a/b")
+	mustAddTestBuild(cacheDir, "two", 10, gcTestNow, "/c")
+	must.OK(os.WriteFile(storeFile(cacheDir, "three")+".123.tmp", nil, 0o644))
+
+	must.OK(cleanCache(cacheDir))
+
+	assert.Equal(t, []cachePackageInfo{}, must.OK1(listCache(cacheDir)))
+	assert.False(t, exists(packageCacheDir(cacheDir, "/a")))
+	assert.False(t, exists(storeFile(cacheDir, "one")))
+	assert.True(t, exists(storeFile(cacheDir, "three")+".123.tmp"))
+}
+
+func TestFormatSize(t *testing.T) {
+	for size, expected := range map[int64]string{
+		0:          "0 B",
+		1023:       "1023 B",
+		1536:       "1.5 KiB",
+		10 << 20:   "10.0 MiB",
+		3 << 40:    "3.0 TiB",
+		5000 << 40: "5000.0 TiB",
+	} {
+		assert.Equal(t, expected, formatSize(size))
+	}
+}
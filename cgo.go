@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//
+// Cgo compiles the preambles of Go files importing "C", and C, C++, Objective-C, Fortran and assembly files of
+// the package, with the flags from '#cgo' directives and CGO_*FLAGS environment variables. The headers and
+// sources they include may be anywhere: next to the including file, or in directories given by -I, often
+// relative to the package as ${SRCDIR}/../include.
+//
+// Includes are followed the way the C preprocessor does, ignoring conditionals, and the files found are hashed.
+// Only files in modules (or the workspace) are followed: system headers and libraries, found in the default
+// directories of the compiler or in absolute directories such as -I/usr/include/foo, are a part of the system
+// rather than of the source code, and their locations would make the key differ between machines.
+//
+
+type cgoPreamble struct {
+	filename string // Go file importing "C"
+	text     string
+}
+
+type cgoDirectives struct {
+	quoteDirs   []string // searched for #include "..." after the directory of the including file
+	includeDirs []string // searched for both #include "..." and #include <...>
+	ldFiles     []string // objects and libraries given by absolute paths to the linker
+	pkgConfig   []string // packages and options of '#cgo pkg-config:'
+}
+
+// readCgoPreamble returns the preamble of import "C" from the header of a Go file, the same way as go/build
+func readCgoPreamble(filename string, header []byte) (string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), filename, header, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+
+	var preamble strings.Builder
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range d.Specs {
+			s, ok := spec.(*ast.ImportSpec)
+			if !ok {
+				continue
+			}
+			if p, err := strconv.Unquote(s.Path.Value); err != nil || p != "C" {
+				continue
+			}
+			doc := s.Doc
+			if doc == nil && len(d.Specs) == 1 {
+				doc = d.Doc
+			}
+			if doc != nil {
+				preamble.WriteString(doc.Text())
+			}
+		}
+	}
+	return preamble.String(), nil
+}
+
+// parseCgoDirectives collects the flags of '#cgo' directives of a package that refer to local files, the same way
+// as go/build: ${SRCDIR} is expanded to the package directory, and relative -I and -L are relative to it
+func parseCgoDirectives(bc *buildContext, dir string, preambles []cgoPreamble, compilerEnv map[string]string) (cgoDirectives, error) {
+	var out cgoDirectives
+	for _, p := range preambles {
+		for _, line := range strings.Split(p.text, "\n") {
+			orig := line
+
+			// Line is
+			//	#cgo [GOOS/GOARCH...] LDFLAGS: stuff
+			//
+			line = strings.TrimSpace(line)
+			if len(line) < 5 || line[:4] != "#cgo" || (line[4] != ' ' && line[4] != '\t') {
+				continue
+			}
+
+			// #cgo (nocallback|noescape) <function name>
+			if fields := strings.Fields(line); len(fields) == 3 && (fields[1] == "nocallback" || fields[1] == "noescape") {
+				continue
+			}
+
+			line, argstr, ok := strings.Cut(strings.TrimSpace(line[4:]), ":")
+			if !ok {
+				return cgoDirectives{}, fmt.Errorf("%s: invalid #cgo line: %s", p.filename, orig)
+			}
+
+			f := strings.Fields(line)
+			if len(f) < 1 {
+				return cgoDirectives{}, fmt.Errorf("%s: invalid #cgo line: %s", p.filename, orig)
+			}
+
+			cond, verb := f[:len(f)-1], f[len(f)-1]
+			if len(cond) > 0 && !slices.ContainsFunc(cond, bc.matchAuto) {
+				continue
+			}
+
+			args, err := splitQuoted(argstr)
+			if err != nil {
+				return cgoDirectives{}, fmt.Errorf("%s: invalid #cgo line: %s", p.filename, orig)
+			}
+			for i, arg := range args {
+				if arg, ok = expandSrcDir(arg, dir); !ok {
+					return cgoDirectives{}, fmt.Errorf("%s: malformed #cgo argument: %s", p.filename, arg)
+				}
+				args[i] = arg
+			}
+
+			switch verb {
+			case "CFLAGS", "CPPFLAGS", "CXXFLAGS", "FFLAGS":
+				makePathsAbsolute(args, dir)
+				out.addIncludeDirs(args)
+			case "LDFLAGS":
+				makePathsAbsolute(args, dir)
+				out.addLDFiles(args)
+			case "pkg-config":
+				out.pkgConfig = append(out.pkgConfig, args...)
+			default:
+				return cgoDirectives{}, fmt.Errorf("%s: invalid #cgo verb: %s", p.filename, orig)
+			}
+		}
+	}
+
+	// Flags from the environment are passed as is, and the compiler is not run in the package directory,
+	// so only absolute paths in them are followed
+	for _, name := range []string{"CGO_CFLAGS", "CGO_CPPFLAGS", "CGO_CXXFLAGS", "CGO_FFLAGS"} {
+		if args, err := splitQuoted(compilerEnv[name]); err == nil {
+			out.addIncludeDirs(args)
+		}
+	}
+	return out, nil
+}
+
+// addIncludeDirs collects absolute include directories from compiler flags
+func (d *cgoDirectives) addIncludeDirs(args []string) {
+	for i, arg := range args {
+		for _, option := range []string{"-iquote", "-isystem", "-idirafter", "-I"} {
+			p, found := strings.CutPrefix(arg, option)
+			if !found {
+				continue
+			}
+			if p == "" && i+1 < len(args) {
+				p = args[i+1]
+			}
+			if !filepath.IsAbs(p) {
+				break
+			}
+			if option == "-iquote" {
+				d.quoteDirs = append(d.quoteDirs, filepath.Clean(p))
+			} else {
+				d.includeDirs = append(d.includeDirs, filepath.Clean(p))
+			}
+			break
+		}
+	}
+}
+
+// addLDFiles collects files given to the linker by absolute paths, such as static libraries
+func (d *cgoDirectives) addLDFiles(args []string) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") || i > 0 && args[i-1] == "-L" || !filepath.IsAbs(arg) {
+			continue
+		}
+		d.ldFiles = append(d.ldFiles, filepath.Clean(arg))
+	}
+}
+
+// cIncludeRE matches the directives of the C preprocessor including other files
+var cIncludeRE = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*(?:include|include_next|import)[ \t]*(?:"([^"\n]*)"|<([^>\n]*)>)`)
+
+// cgoSourceFile tells if the file is compiled by the C compiler for a package using cgo
+func cgoSourceFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".c", ".cc", ".cpp", ".cxx", ".m", ".h", ".hh", ".hpp", ".hxx", ".f", ".F", ".for", ".f90", ".S", ".sx":
+		return true
+	}
+	return false
+}
+
+// addCgoIncludes adds the local files reachable from the preambles and C sources of packages using cgo. Included
+// files may be listed as parts of other packages too, so this is done once all packages have been parsed.
+func addCgoIncludes(pc *parseContext, compilerEnv map[string]string) error {
+	files := slices.Sorted(maps.Keys(pc.checksums))
+	for _, dir := range slices.Sorted(maps.Keys(pc.cgoPreambles)) {
+		directives, err := parseCgoDirectives(pc.build, dir, pc.cgoPreambles[dir], compilerEnv)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range directives.ldFiles {
+			if !localFile(pc, f) {
+				continue
+			}
+			if err := addChecksumUnlessExists(pc, f); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		seen := map[string]bool{}
+		for _, p := range pc.cgoPreambles[dir] {
+			if err := addCIncludes(pc, dir, []byte(p.text), directives, seen); err != nil {
+				return err
+			}
+		}
+		for _, f := range files {
+			if filepath.Dir(f) == dir && cgoSourceFile(f) {
+				if err := addCIncludesOf(pc, f, directives, seen); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func addCIncludesOf(pc *parseContext, filename string, directives cgoDirectives, seen map[string]bool) error {
+	if seen[filename] {
+		return nil
+	}
+	seen[filename] = true
+
+	actualFileName, err := pc.overlay.path(filename)
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(actualFileName)
+	if err != nil {
+		return err
+	}
+	return addCIncludes(pc, filepath.Dir(filename), contents, directives, seen)
+}
+
+// addCIncludes adds the files included by the source code in dir
+func addCIncludes(pc *parseContext, dir string, src []byte, directives cgoDirectives, seen map[string]bool) error {
+	for _, m := range cIncludeRE.FindAllSubmatch(src, -1) {
+		quoted, name := m[1] != nil, string(m[1])
+		if !quoted {
+			name = string(m[2])
+		}
+		if name == "" {
+			continue
+		}
+
+		included := findCInclude(pc, dir, name, quoted, directives)
+		if included == "" || !localFile(pc, included) {
+			continue // A system header, or a missing one the compiler reports
+		}
+		if err := addChecksumUnlessExists(pc, included); err != nil {
+			return err
+		}
+		if err := addCIncludesOf(pc, included, directives, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findCInclude looks an included file up in the order of the C preprocessor
+func findCInclude(pc *parseContext, dir string, name string, quoted bool, directives cgoDirectives) string {
+	if filepath.IsAbs(name) {
+		return existingFile(pc, filepath.Clean(name))
+	}
+
+	var dirs []string
+	if quoted {
+		dirs = append([]string{dir}, directives.quoteDirs...)
+	}
+	for _, d := range append(dirs, directives.includeDirs...) {
+		if f := existingFile(pc, filepath.Join(d, name)); f != "" {
+			return f
+		}
+	}
+	return ""
+}
+
+// localFile tells if the file is in a module or in the workspace, and not in the system
+func localFile(pc *parseContext, filename string) bool {
+	return !filepath.IsAbs(relocatablePath(pc, filename))
+}
+
+// existingFile returns the file name if the file exists, or an empty string
+func existingFile(pc *parseContext, filename string) string {
+	actualFileName, err := pc.overlay.path(filename)
+	if err != nil {
+		return ""
+	}
+	if fi, err := os.Stat(actualFileName); err != nil || fi.IsDir() {
+		return ""
+	}
+	return filename
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func TestReadCgoPreamble(t *testing.T) {
+	header := []byte("package main\n\n// #include <stdio.h>\n// #cgo LDFLAGS: -lm\nimport \"C\"\n\nimport (\n\t\"fmt\"\n)\n")
+	assert.Equal(t, "#include <stdio.h>\n#cgo LDFLAGS: -lm\n", must.OK1(readCgoPreamble("main.go", header)))
+
+	header = []byte("package main\n\n// Not a preamble\nimport (\n\t\"fmt\"\n\n\t// #include <stdlib.h>\n\t\"C\"\n)\n")
+	assert.Equal(t, "#include <stdlib.h>\n", must.OK1(readCgoPreamble("main.go", header)))
+}
+
+func TestParseCgoDirectives(t *testing.T) {
+	bc := newBuildContext(nil, map[string]string{"GOOS": "linux", "GOARCH": "amd64", "CGO_ENABLED": "1"}, toolchainTags{})
+	preambles := []cgoPreamble{{filename: "/src/pkg/main.go", text: `#cgo CFLAGS: -I${SRCDIR}/../include -Ilocal -iquote /opt/quote
+#cgo windows CFLAGS: -I/windows
+#cgo linux,amd64 CPPFLAGS: -I /linux
+#cgo LDFLAGS: -L${SRCDIR}/lib -lfoo ${SRCDIR}/lib/libbar.a
+#cgo pkg-config: --static libpng
+#cgo noescape f
+#include <stdio.h>
+`}}
+
+	d := must.OK1(parseCgoDirectives(bc, "/src/pkg", preambles, map[string]string{"CGO_CFLAGS": "-O2 -I/env -Irelative"}))
+	assert.Equal(t, []string{"/opt/quote"}, d.quoteDirs)
+	assert.Equal(t, []string{"/src/include", "/src/pkg/local", "/linux", "/env"}, d.includeDirs)
+	assert.Equal(t, []string{"/src/pkg/lib/libbar.a"}, d.ldFiles)
+	assert.Equal(t, []string{"--static", "libpng"}, d.pkgConfig)
+
+	_, err := parseCgoDirectives(bc, "/src/pkg", []cgoPreamble{{filename: "/src/pkg/main.go", text: "#cgo CFLAGS -I/x\n"}}, nil)
+	assert.EqualError(t, err, "/src/pkg/main.go: invalid #cgo line: #cgo CFLAGS -I/x")
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+//
+// Binaries of packages using cgo depend on the system toolchain as well: on the C and C++ compilers, and on the
+// flags pkg-config resolves '#cgo pkg-config:' directives to. These are only a part of the key if cgo is in
+// effect for the build: cgo is enabled, and some package of the build imports "C" or has SWIG files.
+//
+// Compilers are identified by their paths and the versions they report, memoized on disk the same way as the
+// version of 'go' binary. The output of pkg-config depends on the libraries installed in the system, so it is
+// memoized by the metadata of the files pkg-config would read as well.
+//
+
+type cgoInfo struct {
+	CC        compilerInfo      `json:"cc"`
+	CXX       compilerInfo      `json:"cxx"`        // only if C++ sources are compiled
+	PkgConfig map[string]string `json:"pkg_config"` // output of pkg-config by the arguments of '#cgo pkg-config:'
+}
+
+type compilerInfo struct {
+	Binary  string `json:"binary"`  // absolute path, or the command as given if it is not found
+	Version string `json:"version"` // first line of --version output
+}
+
+func (c compilerInfo) String() string {
+	if c.Version == "" {
+		return c.Binary
+	}
+	return fmt.Sprintf("%s (%s)", c.Binary, c.Version)
+}
+
+type defaultCompilers struct {
+	CC  string `json:"cc"`
+	CXX string `json:"cxx"`
+}
+
+// resolveCgo returns the cgo part of the caching key, or nil if cgo is not in effect for the build
+func resolveCgo(userCacheDir string, pc *parseContext, compilerEnv map[string]string) (*cgoInfo, error) {
+	cgoDirs := cgoPackageDirs(pc)
+	if !pc.build.ctxt.CgoEnabled || len(cgoDirs) == 0 {
+		return nil, nil
+	}
+
+	out := &cgoInfo{PkgConfig: map[string]string{}}
+	pkgConfig := envOr(compilerEnv, "PKG_CONFIG", "pkg-config")
+	for _, dir := range slices.Sorted(maps.Keys(pc.cgoPreambles)) {
+		directives, err := parseCgoDirectives(pc.build, dir, pc.cgoPreambles[dir], compilerEnv)
+		if err != nil {
+			return nil, err
+		}
+		if len(directives.pkgConfig) == 0 {
+			continue
+		}
+		args := strings.Join(directives.pkgConfig, " ")
+		if _, found := out.PkgConfig[args]; !found {
+			if out.PkgConfig[args], err = lookupPkgConfig(userCacheDir, pkgConfig, dir, directives.pkgConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cxxUsed := false
+	for filename := range pc.checksums {
+		if cxxSourceFile(filename) && cgoDirs[filepath.Dir(filename)] {
+			cxxUsed = true
+			break
+		}
+	}
+
+	// The defaults are only needed if the compilers are not set
+	var defaults defaultCompilers
+	if compilerEnv["CC"] == "" || cxxUsed && compilerEnv["CXX"] == "" {
+		var err error
+		if defaults, err = lookupDefaultCompilers(userCacheDir); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if out.CC, err = lookupCompiler(userCacheDir, envOr(compilerEnv, "CC", defaults.CC)); err != nil {
+		return nil, err
+	}
+	if cxxUsed {
+		if out.CXX, err = lookupCompiler(userCacheDir, envOr(compilerEnv, "CXX", defaults.CXX)); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// cgoPackageDirs returns the directories of the packages compiled through cgo: the ones importing "C", and the
+// ones with SWIG files, which the go command turns into cgo sources
+func cgoPackageDirs(pc *parseContext) map[string]bool {
+	out := map[string]bool{}
+	for dir := range pc.cgoPreambles {
+		out[dir] = true
+	}
+	for filename := range pc.checksums {
+		if ext := filepath.Ext(filename); ext == ".swig" || ext == ".swigcxx" {
+			out[filepath.Dir(filename)] = true
+		}
+	}
+	return out
+}
+
+// cxxSourceFile tells if the file makes the go command compile and link the package with the C++ compiler
+func cxxSourceFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".cc", ".cpp", ".cxx", ".swigcxx":
+		return true
+	}
+	return false
+}
+
+// lookupDefaultCompilers asks 'go' binary for the compilers it uses if CC and CXX are not set. These are chosen
+// when the toolchain is built, and may be overridden by $GOROOT/go.env.
+func lookupDefaultCompilers(userCacheDir string) (defaultCompilers, error) {
+	goBin, goStat, err := lookupBinary(goBinary())
+	if err != nil {
+		return defaultCompilers{}, fmt.Errorf("failed to find go binary: %w", err)
+	}
+
+	memoFile := toolchainMemoFile(userCacheDir, "default-compilers", goBin, goStat, os.Getenv("GOROOT"))
+
+	var defaults defaultCompilers
+	if contents, err := os.ReadFile(memoFile); err == nil && json.Unmarshal(contents, &defaults) == nil {
+		return defaults, nil
+	}
+
+	// Empty CC and CXX are ignored by the go command, and GOENV=off hides the settings made by 'go env -w'
+	envCmd := exec.Command(goBin, "env", "-json", "CC", "CXX")
+	envCmd.Env = append(os.Environ(), "GOTOOLCHAIN=local", "GOENV=off", "CC=", "CXX=")
+	envCmd.Dir = "/"
+	envCmd.Stderr = os.Stderr
+	out, err := envCmd.Output()
+	if err != nil {
+		return defaultCompilers{}, fmt.Errorf("failed to query %s for C compilers: %w", goBin, err)
+	}
+
+	var goEnv struct {
+		CC  string
+		CXX string
+	}
+	if err := json.Unmarshal(out, &goEnv); err != nil {
+		return defaultCompilers{}, fmt.Errorf("failed to query %s for C compilers: %w", goBin, err)
+	}
+	defaults = defaultCompilers{CC: goEnv.CC, CXX: goEnv.CXX}
+
+	contents, err := json.Marshal(defaults)
+	if err != nil {
+		panic(fmt.Errorf("internal error: compiler information is not marshalable: %w", err))
+	}
+	if err := writeFileAtomically(memoFile, contents); err != nil {
+		return defaultCompilers{}, fmt.Errorf("failed to memoize compiler information: %w", err)
+	}
+	return defaults, nil
+}
+
+// lookupCompiler identifies the compiler given by the value of CC or CXX: a command, possibly with arguments.
+// If the compiler can't be found or run, the go command reports it, so it is not an error here.
+func lookupCompiler(userCacheDir string, command string) (compilerInfo, error) {
+	args, err := splitQuoted(command)
+	if err != nil || len(args) == 0 {
+		return compilerInfo{Binary: command}, nil
+	}
+	bin, stat, err := lookupBinary(args[0])
+	if err != nil {
+		return compilerInfo{Binary: args[0]}, nil
+	}
+
+	// Arguments may select another compiler, as in CC="zig cc"
+	memoFile := toolchainMemoFile(userCacheDir, "compiler", bin, stat, args[1:])
+
+	var info compilerInfo
+	if contents, err := os.ReadFile(memoFile); err == nil && json.Unmarshal(contents, &info) == nil {
+		return info, nil
+	}
+
+	info = compilerInfo{Binary: bin}
+	versionCmd := exec.Command(bin, append(args[1:], "--version")...)
+	versionCmd.Dir = "/"
+	if out, err := versionCmd.Output(); err == nil {
+		info.Version, _, _ = strings.Cut(strings.TrimSpace(string(out)), "\n")
+	}
+
+	contents, err := json.Marshal(info)
+	if err != nil {
+		panic(fmt.Errorf("internal error: compiler information is not marshalable: %w", err))
+	}
+	if err := writeFileAtomically(memoFile, contents); err != nil {
+		return compilerInfo{}, fmt.Errorf("failed to memoize compiler information: %w", err)
+	}
+	return info, nil
+}
+
+// lookupPkgConfig returns what pkg-config tells about the packages, the same way the go command asks it in the
+// package directory. Libraries may be upgraded without changing the flags, so their versions are included.
+//
+// The output is memoized by the identity of pkg-config, its environment, and the metadata of the directories
+// it searches and the .pc files of the packages in them: installing, removing or upgrading a library changes
+// some of these.
+//
+// If pkg-config fails, so does the build, and the go command reports it, so the error becomes the output.
+func lookupPkgConfig(userCacheDir string, pkgConfig string, dir string, args []string) (string, error) {
+	var flags, pkgs []string
+	for _, arg := range args {
+		switch {
+		case arg == "--":
+		case strings.HasPrefix(arg, "--"):
+			flags = append(flags, arg)
+		default:
+			pkgs = append(pkgs, arg)
+		}
+	}
+	if len(pkgs) == 0 {
+		return "", nil
+	}
+
+	bin, stat, err := lookupBinary(pkgConfig)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err), nil
+	}
+	searchPath, err := lookupPkgConfigPath(userCacheDir, bin, stat)
+	if err != nil {
+		return "", err
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "PKG_CONFIG_") {
+			env = append(env, kv)
+		}
+	}
+	slices.Sort(env)
+
+	var searchDirs []string
+	for _, name := range []string{"PKG_CONFIG_PATH", "PKG_CONFIG_LIBDIR"} {
+		searchDirs = append(searchDirs, filepath.SplitList(os.Getenv(name))...)
+	}
+	searchDirs = append(searchDirs, filepath.SplitList(searchPath)...)
+	stats := map[string]fileStat{}
+	for _, d := range searchDirs {
+		for _, f := range append([]string{d}, pcFiles(d, pkgs)...) {
+			if fi, err := os.Stat(f); err == nil {
+				stats[f] = newFileStat(fi)
+			}
+		}
+	}
+
+	memoFile := toolchainMemoFile(userCacheDir, "pkg-config", bin, stat, dir, args, env, stats)
+
+	var out string
+	if contents, err := os.ReadFile(memoFile); err == nil && json.Unmarshal(contents, &out) == nil {
+		return out, nil
+	}
+
+	out, err = runPkgConfig(bin, dir, flags, pkgs)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err), nil
+	}
+
+	contents, err := json.Marshal(out)
+	if err != nil {
+		panic(fmt.Errorf("internal error: pkg-config output is not marshalable: %w", err))
+	}
+	if err := writeFileAtomically(memoFile, contents); err != nil {
+		return "", fmt.Errorf("failed to memoize pkg-config output: %w", err)
+	}
+	return out, nil
+}
+
+// pcFiles names the files the packages would be described by in the directory
+func pcFiles(dir string, pkgs []string) []string {
+	out := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		out = append(out, filepath.Join(dir, pkg+".pc"))
+	}
+	return out
+}
+
+// lookupPkgConfigPath asks pkg-config for its default search path
+func lookupPkgConfigPath(userCacheDir string, bin string, stat fileStat) (string, error) {
+	memoFile := toolchainMemoFile(userCacheDir, "pkg-config-path", bin, stat)
+
+	var searchPath string
+	if contents, err := os.ReadFile(memoFile); err == nil && json.Unmarshal(contents, &searchPath) == nil {
+		return searchPath, nil
+	}
+
+	// A failure leaves the search path empty, and then only the environment tells where the packages are
+	cmd := exec.Command(bin, "--variable", "pc_path", "pkg-config")
+	cmd.Dir = "/"
+	if out, err := cmd.Output(); err == nil {
+		searchPath = strings.TrimSpace(string(out))
+	}
+
+	contents, err := json.Marshal(searchPath)
+	if err != nil {
+		panic(fmt.Errorf("internal error: pkg-config search path is not marshalable: %w", err))
+	}
+	if err := writeFileAtomically(memoFile, contents); err != nil {
+		return "", fmt.Errorf("failed to memoize pkg-config search path: %w", err)
+	}
+	return searchPath, nil
+}
+
+func runPkgConfig(bin string, dir string, flags []string, pkgs []string) (string, error) {
+	var out strings.Builder
+	for _, query := range [][]string{
+		append(append([]string{"--cflags", "--libs"}, flags...), "--"),
+		{"--modversion", "--"},
+	} {
+		cmd := exec.Command(bin, append(query, pkgs...)...)
+		cmd.Dir = dir
+		res, err := cmd.Output()
+		if err != nil {
+			return "", err
+		}
+		out.Write(res)
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	fileName := filepath.Join(dir, name)
+	must.OK(os.WriteFile(fileName, []byte("#!/bin/sh\n"+body+"\n"), 0o755))
+	return fileName
+}
+
+func TestResolveCgo(t *testing.T) {
+	cacheDir, binDir := t.TempDir(), t.TempDir()
+	env := map[string]string{
+		"CGO_ENABLED": "1",
+		"GOOS":        "linux",
+		"CC":          writeScript(t, binDir, "cc", `echo "cc 1.0 $*"; echo "Target: test"`),
+		"CXX":         writeScript(t, binDir, "c++", `echo "c++ 2.0 $*"`),
+		"PKG_CONFIG":  writeScript(t, binDir, "pkg-config", `echo "$*"`),
+	}
+
+	pc := must.OK1(parseSources(cacheDir, "testdata/cgo-toolchain", nil, env, nil))
+	assert.Equal(t, &cgoInfo{
+		CC:  compilerInfo{Binary: env["CC"], Version: "cc 1.0 --version"},
+		CXX: compilerInfo{Binary: env["CXX"], Version: "c++ 2.0 --version"},
+		PkgConfig: map[string]string{
+			"--static libfoo libbar": "--cflags --libs --static -- libfoo libbar\n--modversion -- libfoo libbar\n",
+		},
+	}, must.OK1(resolveCgo(cacheDir, pc, env)))
+
+	// Arguments of the compiler are passed along
+	env["CC"] += " -m32"
+	cgo := must.OK1(resolveCgo(cacheDir, pc, env))
+	assert.Equal(t, compilerInfo{Binary: filepath.Join(binDir, "cc"), Version: "cc 1.0 -m32 --version"}, cgo.CC)
+
+	// The system toolchain is not an input without cgo
+	pc = must.OK1(parseSources(cacheDir, "testdata/cgo-toolchain", nil, map[string]string{"CGO_ENABLED": "0"}, nil))
+	assert.Zero(t, must.OK1(resolveCgo(cacheDir, pc, env)))
+	pc = must.OK1(parseSources(cacheDir, "testdata/cgo-toolchain/nocgo", nil, env, nil))
+	assert.Zero(t, must.OK1(resolveCgo(cacheDir, pc, env)))
+
+	// SWIG files are compiled through cgo without importing "C"
+	pc = must.OK1(parseSources(cacheDir, "testdata/swig", nil, env, nil))
+	assert.Equal(t, &cgoInfo{
+		CC:        compilerInfo{Binary: filepath.Join(binDir, "cc"), Version: "cc 1.0 -m32 --version"},
+		CXX:       compilerInfo{Binary: env["CXX"], Version: "c++ 2.0 --version"},
+		PkgConfig: map[string]string{},
+	}, must.OK1(resolveCgo(cacheDir, pc, env)))
+}
+
+func TestLookupPkgConfigIsMemoized(t *testing.T) {
+	cacheDir, binDir, pcDir := t.TempDir(), t.TempDir(), t.TempDir()
+	calls := filepath.Join(t.TempDir(), "calls")
+	pkgConfig := writeScript(t, binDir, "pkg-config", `echo "$*" >> `+calls+`; echo "$*"`)
+	t.Setenv("PKG_CONFIG_PATH", pcDir)
+	must.OK(os.WriteFile(filepath.Join(pcDir, "libfoo.pc"), []byte("Version: 1.0\n"), 0o644))
+
+	lookup := func() string {
+		return must.OK1(lookupPkgConfig(cacheDir, pkgConfig, "/", []string{"libfoo"}))
+	}
+	queries := func() int {
+		return strings.Count(string(must.OK1(os.ReadFile(calls))), "--modversion")
+	}
+
+	assert.Equal(t, "--cflags --libs -- libfoo\n--modversion -- libfoo\n", lookup())
+	assert.Equal(t, 1, queries())
+	lookup()
+	assert.Equal(t, 1, queries())
+
+	// Upgrading a library changes the metadata of its .pc file
+	must.OK(os.WriteFile(filepath.Join(pcDir, "libfoo.pc"), []byte("Version: 2.0.0\n"), 0o644))
+	lookup()
+	assert.Equal(t, 2, queries())
+
+	// So does installing one
+	must.OK(os.WriteFile(filepath.Join(pcDir, "libbar.pc"), []byte("Version: 1.0\n"), 0o644))
+	lookup()
+	assert.Equal(t, 3, queries())
+
+	// Failures are not memoized
+	installed := filepath.Join(t.TempDir(), "installed")
+	flaky := writeScript(t, t.TempDir(), "pkg-config", `test -e `+installed+` || exit 1; echo ok`)
+	assert.Equal(t, "error: exit status 1", must.OK1(lookupPkgConfig(cacheDir, flaky, "/", []string{"libfoo"})))
+	must.OK(os.WriteFile(installed, nil, 0o644))
+	assert.Equal(t, "ok\nok\n", must.OK1(lookupPkgConfig(cacheDir, flaky, "/", []string{"libfoo"})))
+}
+
+func TestLookupCompilerIsMemoized(t *testing.T) {
+	cacheDir, binDir := t.TempDir(), t.TempDir()
+	cc := writeScript(t, binDir, "cc", `echo "cc 1.0"`)
+
+	assert.Equal(t, compilerInfo{Binary: cc, Version: "cc 1.0"}, must.OK1(lookupCompiler(cacheDir, cc)))
+
+	// Replacing the compiler changes its metadata
+	must.OK(os.Rename(writeScript(t, t.TempDir(), "cc", `echo "cc 2.0"`), cc))
+	assert.Equal(t, compilerInfo{Binary: cc, Version: "cc 2.0"}, must.OK1(lookupCompiler(cacheDir, cc)))
+
+	memos := must.OK1(os.ReadDir(toolchainMemoDir(cacheDir)))
+	assert.Equal(t, 2, len(memos))
+
+	// Missing compilers are reported by the go command
+	assert.Equal(t, compilerInfo{Binary: "no-such-cc"}, must.OK1(lookupCompiler(cacheDir, "no-such-cc")))
+}
+
+func TestLookupDefaultCompilers(t *testing.T) {
+	t.Setenv("CC", "should-be-ignored")
+
+	defaults := must.OK1(lookupDefaultCompilers(t.TempDir()))
+	assert.NotZero(t, defaults.CC)
+	assert.NotEqual(t, "should-be-ignored", defaults.CC)
+	assert.NotZero(t, defaults.CXX)
+}
@@ -5,14 +5,19 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	gobuild "go/build"
 	"go/parser"
 	"go/token"
-	"io"
+	"go/version"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/mod/modfile"
 )
@@ -33,39 +38,153 @@ import (
 //
 
 type moduleInfo struct {
-	path     string
-	packages map[string]string // remote imports are marked by empty strings
+	path      string
+	dir       string
+	goVersion string
+	toolchain string
+	packages  map[string]string // remote imports are marked by empty strings
+	tools     []string          // packages from 'tool' directives
 }
 
+type workspaceInfo struct {
+	dir       string
+	goVersion string
+	toolchain string
+	modules   map[string]bool   // paths of modules in workspace
+	packages  map[string]string // same as moduleInfo.packages, merged from all modules in workspace
+	tools     []string          // same as moduleInfo.tools, merged from all modules in workspace
+}
+
+//
+// Packages are parsed concurrently: every package is handled by its own goroutine, and reading, parsing and
+// hashing of files is done by at most parseParallelism goroutines at once. The order of completion does not
+// affect the result: checksums are keyed by file name, and if there are several errors, the same one is
+// reported every time.
+//
+
+var parseParallelism = max(runtime.GOMAXPROCS(0), 4)
+
 type parseContext struct {
+	mu sync.Mutex // protects checksums, packages, imports, cgoPreambles and errs
+
 	// Parsing populates this field with the checksums of files that comprise source code
 	checksums map[string]string
 
-	packages map[string]bool
-	modules  map[string]*moduleInfo
+	packages     map[string]bool
+	imports      map[string][]string      // directories of local imports, by package directory
+	cgoPreambles map[string][]cgoPreamble // by package directory, for packages using cgo
+	errs         []error
+
+	modulesMu sync.Mutex // protects modules, held during module lookup
+	modules   map[string]*moduleInfo
+
+	// These fields are set before parsing starts
+	mainModule *moduleInfo
+	workspace  *workspaceInfo // nil if not in workspace mode
+	vendorDir  string         // empty if not in vendor mode
+	modFile    string         // alternate go.mod of the main module given by -modfile, empty if none
+	overlay    *overlay       // nil if -overlay is not given
+	toolchain  toolchainInfo
+	build      *buildContext   // matches files for the selected toolchain
+	hashes     *hashIndex      // nil if file hashes are not cached
+	stdlib     map[string]bool // import paths of the standard library packages
+
+	wg        sync.WaitGroup // tracks packages being parsed
+	semaphore chan struct{}  // limits the number of goroutines doing IO or parsing
+}
+
+func newParseContext(hashes *hashIndex) *parseContext {
+	return &parseContext{
+		checksums:    map[string]string{},
+		packages:     map[string]bool{},
+		imports:      map[string][]string{},
+		cgoPreambles: map[string][]cgoPreamble{},
+		modules:      map[string]*moduleInfo{},
+		hashes:       hashes,
+		semaphore:    make(chan struct{}, parseParallelism),
+	}
+}
+
+// limit runs f, waiting for a free slot if there are too many goroutines doing IO or parsing already.
+// f must not wait for other goroutines calling limit, or parsing may deadlock.
+func (pc *parseContext) limit(f func()) {
+	pc.semaphore <- struct{}{}
+	defer func() { <-pc.semaphore }()
+	f()
+}
+
+// parallel runs f(0)...f(n-1) concurrently, limited by pc.limit, and returns the error with the lowest index
+func (pc *parseContext) parallel(n int, f func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pc.limit(func() { errs[i] = f(i) })
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait waits for all scheduled packages to be parsed
+func (pc *parseContext) wait() error {
+	pc.wg.Wait()
+
+	if len(pc.errs) == 0 {
+		return nil
+	}
+	// Errors are collected in random order, pick a stable one
+	return slices.MinFunc(pc.errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
 }
 
 func addChecksum(pc *parseContext, filename string) error {
+	pc.mu.Lock()
 	if _, exists := pc.checksums[filename]; exists {
+		pc.mu.Unlock()
 		panic(fmt.Errorf("internal error: a checksum has been requested twice for file %q", filename))
 	}
+	pc.checksums[filename] = "" // Reserve the entry
+	pc.mu.Unlock()
 
-	fh, err := os.Open(filename)
-	if err != nil {
-		return err
+	actualFileName, err := pc.overlay.path(filename)
+	var digest string
+	if err == nil {
+		digest, err = pc.hashes.fileDigest(actualFileName)
 	}
-	defer fh.Close()
 
-	h := sha256.New()
-	if _, err := io.Copy(h, fh); err != nil {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if err != nil {
+		delete(pc.checksums, filename)
 		return err
 	}
-
-	pc.checksums[filename] = hex.EncodeToString(h.Sum(nil))
+	pc.checksums[filename] = digest
 	return nil
 }
 
+// addChecksumUnlessExists is addChecksum for files that may be reached in several ways, such as included ones
+func addChecksumUnlessExists(pc *parseContext, filename string) error {
+	pc.mu.Lock()
+	_, exists := pc.checksums[filename]
+	pc.mu.Unlock()
+	if exists {
+		return nil
+	}
+	return addChecksum(pc, filename)
+}
+
 func findModule(pc *parseContext, dir string) (*moduleInfo, error) {
+	pc.modulesMu.Lock()
+	defer pc.modulesMu.Unlock()
+
 	origDir := dir
 
 	var info *moduleInfo
@@ -108,8 +227,14 @@ func findModule(pc *parseContext, dir string) (*moduleInfo, error) {
 	return info, nil
 }
 
+// parseModule parses go.mod in dir. The main module is always looked up first, so if -modfile is given, the
+// alternate go.mod and go.sum files are used instead for the first module parsed.
 func parseModule(pc *parseContext, dir string) (*moduleInfo, error) {
-	goModFileName := filepath.Join(dir, "go.mod")
+	goModFileName, goSumFileName := filepath.Join(dir, "go.mod"), filepath.Join(dir, "go.sum")
+	if pc.modFile != "" && pc.mainModule == nil {
+		goModFileName, goSumFileName = pc.modFile, strings.TrimSuffix(pc.modFile, ".mod")+".sum"
+	}
+
 	contents, err := os.ReadFile(goModFileName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse module: %w", err)
@@ -122,46 +247,193 @@ func parseModule(pc *parseContext, dir string) (*moduleInfo, error) {
 
 	out := &moduleInfo{
 		path: f.Module.Mod.Path,
+		dir:  dir,
 		packages: map[string]string{
 			f.Module.Mod.Path: dir,
 		},
 	}
 
+	if f.Go != nil {
+		out.goVersion = f.Go.Version
+	}
+	if f.Toolchain != nil {
+		out.toolchain = f.Toolchain.Name
+	}
+
 	for _, r := range f.Require {
 		out.packages[r.Mod.Path] = ""
 	}
 
+	for _, t := range f.Tool {
+		out.tools = append(out.tools, t.Path)
+	}
+
 	for _, r := range f.Replace {
 		if r.New.Version != "" {
 			continue
 		}
 
 		// It's a local directory replacement
-		if strings.HasPrefix(r.New.Path, "/") {
-			out.packages[stripPackageQuotes(r.Old.Path)] = r.New.Path
+		out.packages[stripPackageQuotes(r.Old.Path)] = absPathFrom(dir, r.New.Path)
+	}
+
+	if err := addChecksum(pc, goModFileName); err != nil {
+		return nil, err
+	}
+	if err := addChecksum(pc, goSumFileName); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// Mirrors the lookup done by the go command: GOWORK=off disables workspace mode,
+// GOWORK=<path> points to go.work explicitly, otherwise go.work is searched upwards
+// from the directory the build is run in.
+func findWorkspace(dir string, compilerEnv map[string]string) (string, error) {
+	if gowork := compilerEnv["GOWORK"]; gowork != "" {
+		if gowork == "off" {
+			return "", nil
+		}
+		if !filepath.IsAbs(gowork) {
+			return "", fmt.Errorf("invalid GOWORK: must be an absolute path: %q", gowork)
+		}
+		return gowork, nil
+	}
+
+	for {
+		goWorkFileName := filepath.Join(dir, "go.work")
+		fi, err := os.Stat(goWorkFileName)
+		if err == nil && !fi.IsDir() {
+			return goWorkFileName, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read %s: %w", goWorkFileName, err)
+		}
+
+		if dir == "/" {
+			return "", nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func parseWorkspace(pc *parseContext, goWorkFileName string) (*workspaceInfo, error) {
+	contents, err := os.ReadFile(goWorkFileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse workspace: %w", err)
+	}
+
+	f, err := modfile.ParseWork(goWorkFileName, contents, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse workspace: %w", err)
+	}
+
+	workDir := filepath.Dir(goWorkFileName)
+	out := &workspaceInfo{
+		dir:      workDir,
+		modules:  map[string]bool{},
+		packages: map[string]string{},
+	}
+	if f.Go != nil {
+		out.goVersion = f.Go.Version
+	}
+	if f.Toolchain != nil {
+		out.toolchain = f.Toolchain.Name
+	}
+
+	// Every module in workspace is a main module, so all of their requirements and
+	// replacements are in effect. Local replacements win over requirements.
+	var modules []*moduleInfo
+	for _, u := range f.Use {
+		moduleDir := absPathFrom(workDir, u.Path)
+		info, err := findModule(pc, moduleDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse module %q used in %s: %w", u.Path, goWorkFileName, err)
+		}
+		modules = append(modules, info)
+
+		for p, d := range info.packages {
+			if _, exists := out.packages[p]; !exists || d != "" {
+				out.packages[p] = d
+			}
+		}
+	}
+
+	// Replacements in go.work override replacements in go.mod files
+	for _, r := range f.Replace {
+		if r.New.Version != "" {
+			out.packages[stripPackageQuotes(r.Old.Path)] = ""
 		} else {
-			out.packages[stripPackageQuotes(r.Old.Path)] = filepath.Join(dir, r.New.Path)
+			out.packages[stripPackageQuotes(r.Old.Path)] = absPathFrom(workDir, r.New.Path)
 		}
 	}
 
-	if err := addChecksum(pc, filepath.Join(dir, "go.mod")); err != nil {
+	// Workspace modules themselves can't be replaced
+	for _, m := range modules {
+		out.modules[m.path] = true
+		out.packages[m.path] = m.dir
+	}
+
+	for _, m := range modules {
+		out.tools = append(out.tools, m.tools...)
+	}
+	slices.Sort(out.tools)
+	out.tools = slices.Compact(out.tools)
+
+	if err := addChecksum(pc, goWorkFileName); err != nil {
 		return nil, err
 	}
-	if err := addChecksum(pc, filepath.Join(dir, "go.sum")); err != nil && !os.IsNotExist(err) {
+	if err := addChecksum(pc, goWorkFileName+".sum"); err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
 
 	return out, nil
 }
 
+// Mirrors the choice of -mod default by the go command: vendor directory is used if it is
+// present and go version of the main module (or workspace) is recent enough.
+func findVendorDir(pc *parseContext, compilerFlags []string, compilerEnv map[string]string) (string, error) {
+	root, goVersion, minGoVersion := pc.mainModule.dir, pc.mainModule.goVersion, "go1.14"
+	if pc.workspace != nil {
+		root, goVersion, minGoVersion = pc.workspace.dir, pc.workspace.goVersion, "go1.22"
+	}
+	vendorDir := filepath.Join(root, "vendor")
+
+	if mod, found := goFlag(compilerFlags, compilerEnv, "mod"); found && mod != "" {
+		if mod != "vendor" {
+			return "", nil
+		}
+		return vendorDir, nil
+	}
+
+	fi, err := os.Stat(vendorDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read %s: %w", vendorDir, err)
+	}
+	if !fi.IsDir() || version.Compare("go"+goVersion, minGoVersion) < 0 {
+		return "", nil
+	}
+	return vendorDir, nil
+}
+
+func absPathFrom(base, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(base, p)
+}
+
 func stripPackageQuotes(p string) string {
 	return strings.TrimPrefix(strings.TrimSuffix(p, `"`), `"`)
 }
 
-// Go compiler cares about .go
-// CGo cares about the rest of the extensions: https://pkg.go.dev/cmd/cgo
-var srcRE = regexp.MustCompile(`\.(go|s|S|c|cc|cpp|cxx|m|h|hh|hpp|hxx|f|F|for|f90)$`)
-
+// packageFile tells if the file is a part of the package, by the same rules as go/build: Go compiler cares about
+// .go and .s, cgo cares about C, C++, Objective-C, Fortran and assembly sources and headers
+// (https://pkg.go.dev/cmd/cgo), SWIG about .swig and .swigcxx, and the linker about .syso objects.
 func packageFile(name string) bool {
 	// We don't care about tests
 	if strings.HasSuffix(name, "_test.go") {
@@ -173,94 +445,205 @@ func packageFile(name string) bool {
 		return false
 	}
 
-	return srcRE.MatchString(name)
+	switch filepath.Ext(name) {
+	case ".go", ".s", ".S", ".sx", ".c", ".cc", ".cpp", ".cxx", ".m", ".h", ".hh", ".hpp", ".hxx",
+		".f", ".F", ".for", ".f90", ".swig", ".swigcxx", ".syso":
+		return true
+	}
+	return false
 }
 
-var stdlibPackageRE = regexp.MustCompile(`^\"[a-z]+(/|")`)
+// parsePackage schedules parsing of a package, unless it has been scheduled already.
+// Use pc.wait() to wait for the parsing to finish.
+func parsePackage(pc *parseContext, dir string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
 
-func parsePackage(pc *parseContext, dir string) error {
 	if pc.packages[dir] { // Don't parse the same package twice
-		return nil
+		return
 	}
 	pc.packages[dir] = true
 
+	pc.wg.Add(1)
+	go func() {
+		defer pc.wg.Done()
+
+		if err := parsePackageDir(pc, dir); err != nil {
+			pc.mu.Lock()
+			pc.errs = append(pc.errs, err)
+			pc.mu.Unlock()
+		}
+	}()
+}
+
+type parsedFile struct {
+	imports       []string
+	embedPatterns []string
+	cgo           bool // imports "C"
+	cgoPreamble   string
+}
+
+func parsePackageDir(pc *parseContext, dir string) error {
 	// Make sure module for all packages are resolved, otherwise go.mod/go.sum may not
 	// be included in checksum calculation for packages that only uses stdlib.
 	if _, err := findModule(pc, dir); err != nil {
 		return err
 	}
 
-	var embedPatterns []string
-
-	fset := token.NewFileSet()
-
-	des, err := os.ReadDir(dir)
+	var des []os.DirEntry
+	var err error
+	pc.limit(func() { des, err = pc.overlay.readDir(dir) })
 	if err != nil {
 		return err
 	}
 
+	var names []string
 	for _, de := range des {
 		if de.Type() != 0 { // Not a regular file
 			continue
 		}
 
-		if !packageFile(de.Name()) {
+		if !packageFile(de.Name()) || !pc.build.goodOSArchFile(de.Name()) {
 			continue
 		}
 
-		if err := addChecksum(pc, filepath.Join(dir, de.Name())); err != nil {
-			return err
-		}
+		names = append(names, de.Name())
+	}
 
-		if strings.HasSuffix(de.Name(), ".go") { // Only .go files may contain imports
-			node, err := parser.ParseFile(fset, filepath.Join(dir, de.Name()), nil, parser.SkipObjectResolution|parser.ParseComments)
-			if err != nil {
-				return fmt.Errorf("failed to parse %s/%s: %w", dir, de.Name(), err)
-			}
+	files := make([]*parsedFile, len(names))
+	if err := pc.parallel(len(names), func(i int) error {
+		var err error
+		files[i], err = parseFile(pc, filepath.Join(dir, names[i]))
+		return err
+	}); err != nil {
+		return err
+	}
 
-			for _, imp := range node.Imports {
-				if stdlibPackageRE.MatchString(imp.Path.Value) {
-					continue
-				}
-				dir, local, err := resolveImport(pc, dir, stripPackageQuotes(imp.Path.Value))
-				if err != nil {
-					return err
-				}
+	var embedPatterns []string
+	var imports []string
+	var cgoPreambles []cgoPreamble
+	for i, f := range files {
+		if f == nil { // Excluded from build
+			continue
+		}
 
-				// Checksumming of non-local imports is done by checksumming go.mod/go.sum
-				if !local {
-					continue
-				}
+		if f.cgo {
+			cgoPreambles = append(cgoPreambles, cgoPreamble{filename: filepath.Join(dir, names[i]), text: f.cgoPreamble})
+		}
 
-				if err := parsePackage(pc, dir); err != nil {
-					return err
-				}
+		for _, imp := range f.imports {
+			importDir, local, err := resolveImport(pc, dir, imp)
+			if err != nil {
+				return err
 			}
 
-			for _, commentGroup := range node.Comments {
-				for _, comment := range commentGroup.List {
-					if s, found := strings.CutPrefix(comment.Text, "//go:embed "); found {
-						patterns, err := parseGoEmbed(s)
-						if err != nil {
-							return fmt.Errorf("failed to parse //go:embed comment in %q: %w", comment.Text, err)
-						}
-						embedPatterns = append(embedPatterns, patterns...)
-					}
-				}
+			// Checksumming of non-local imports is done by checksumming go.mod/go.sum
+			if !local {
+				continue
 			}
+
+			parsePackage(pc, importDir)
+			imports = append(imports, importDir)
 		}
+
+		embedPatterns = append(embedPatterns, f.embedPatterns...)
+	}
+
+	slices.Sort(imports)
+	pc.mu.Lock()
+	pc.imports[dir] = slices.Compact(imports)
+	if cgoPreambles != nil {
+		pc.cgoPreambles[dir] = cgoPreambles
 	}
+	pc.mu.Unlock()
 
-	files, _, err := resolveEmbed(dir, embedPatterns)
+	var embedFiles []string
+	pc.limit(func() { embedFiles, _, err = resolveEmbed(dir, embedPatterns) })
 	if err != nil {
 		return fmt.Errorf("failed to resolve //go:embed patterns: %w", err)
 	}
-	for _, f := range slices.Sorted(slices.Values(files)) {
-		if err := addChecksum(pc, filepath.Join(dir, f)); err != nil {
-			return err
+	return pc.parallel(len(embedFiles), func(i int) error {
+		return addChecksum(pc, filepath.Join(dir, embedFiles[i]))
+	})
+}
+
+// parseFile returns nil if the file is excluded from the build
+func parseFile(pc *parseContext, filename string) (*parsedFile, error) {
+	// Objects are binary, so they can only be excluded by their names
+	if strings.HasSuffix(filename, ".syso") {
+		if err := addChecksum(pc, filename); err != nil {
+			return nil, err
 		}
+		return &parsedFile{}, nil
 	}
-	return nil
+
+	actualFileName, err := pc.overlay.path(filename)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(actualFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	// Only .go files may contain imports, other files may only contain build constraints
+	var info goFileInfo
+	var readErr error
+	if strings.HasSuffix(filename, ".go") {
+		info, readErr = readGoInfo(fh)
+	} else {
+		info.header, readErr = readComments(fh)
+	}
+	if readErr != nil && readErr != errSyntax {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, readErr)
+	}
+
+	// Syntax errors in excluded files do not matter
+	match, err := pc.build.matchFile(filename, info.header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	if !match {
+		return nil, nil
+	}
+	if readErr == errSyntax {
+		// The reader only knows that something is wrong, go/parser is able to tell what and where
+		src, err := os.ReadFile(actualFileName)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), filename, src, parser.ImportsOnly); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+		}
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, readErr)
+	}
+
+	// Files using cgo are silently skipped if cgo is disabled
+	if !pc.build.ctxt.CgoEnabled && slices.Contains(info.imports, "C") {
+		return nil, nil
+	}
+
+	out := &parsedFile{embedPatterns: info.embedPatterns}
+	if slices.Contains(info.imports, "C") {
+		out.cgo = true
+		if out.cgoPreamble, err = readCgoPreamble(filename, info.header); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+		}
+	}
+	for _, imp := range info.imports {
+		if imp == "C" || pc.stdlib[imp] {
+			continue
+		}
+		out.imports = append(out.imports, imp)
+	}
+
+	if err := addChecksum(pc, filename); err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
 func packageInsideOf(path, base string) bool {
@@ -274,24 +657,66 @@ func dirForPackageInModule(modulePath string, moduleDir string, importPath strin
 	return filepath.Join(moduleDir, strings.TrimPrefix(importPath, modulePath+"/"))
 }
 
+func longestMatch(packages map[string]string, importPath string) (retPath string, retDir string) {
+	for modulePackagePath, modulePackageDir := range packages {
+		if packageInsideOf(importPath, modulePackagePath) && len(modulePackagePath) > len(retPath) {
+			retPath = modulePackagePath
+			retDir = modulePackageDir
+		}
+	}
+	return retPath, retDir
+}
+
+func isMainModulePackage(pc *parseContext, importPath string) bool {
+	if pc.workspace != nil {
+		matchedPath, _ := longestMatch(pc.workspace.packages, importPath)
+		return pc.workspace.modules[matchedPath]
+	}
+	matchedPath, _ := longestMatch(pc.mainModule.packages, importPath)
+	return matchedPath == pc.mainModule.path
+}
+
 func resolveImport(pc *parseContext, dir string, importPath string) (retDir string, retLocal bool, _ error) {
+	// In vendor mode all packages outside of main modules, local or not, are loaded from vendor directory
+	if pc.vendorDir != "" && !isMainModulePackage(pc, importPath) {
+		vendoredDir := filepath.Join(pc.vendorDir, importPath)
+		if _, err := os.Stat(vendoredDir); err != nil {
+			if os.IsNotExist(err) {
+				// As in module mode, the package may be in the standard library of a newer toolchain
+				if stdImportPath(importPath) {
+					return "", false, nil
+				}
+				return "", false, fmt.Errorf("package %q is not found in vendor directory %q", importPath, pc.vendorDir)
+			}
+			return "", false, err
+		}
+		return vendoredDir, true, nil
+	}
+
+	// In workspace mode the build list is shared by all modules in workspace
+	if pc.workspace != nil {
+		if matchedPath, matchedPathDir := longestMatch(pc.workspace.packages, importPath); matchedPath != "" {
+			if matchedPathDir == "" {
+				return "", false, nil
+			}
+			return dirForPackageInModule(matchedPath, matchedPathDir, importPath), true, nil
+		}
+	}
+
 	for {
 		moduleInfo, err := findModule(pc, dir)
 		if err != nil {
 			return "", false, err
 		}
 
-		var longestMatchedPath string
-		var longestMatchedPathDir string
-
-		for modulePackagePath, modulePackageDir := range moduleInfo.packages {
-			if packageInsideOf(importPath, modulePackagePath) && len(modulePackagePath) > len(longestMatchedPath) {
-				longestMatchedPath = modulePackagePath
-				longestMatchedPathDir = modulePackageDir
-			}
-		}
+		longestMatchedPath, longestMatchedPathDir := longestMatch(moduleInfo.packages, importPath)
 
 		if longestMatchedPath == "" {
+			// The package may be in the standard library of a newer toolchain than the local one, and if it
+			// is not, the go command reports it is not in std
+			if stdImportPath(importPath) {
+				return "", false, nil
+			}
 			return "", false, fmt.Errorf("package %q is outside of every module", importPath)
 		}
 
@@ -310,36 +735,261 @@ func resolveImport(pc *parseContext, dir string, importPath string) (retDir stri
 	}
 }
 
-func packageSourceChecksums(dir string) (map[string]string, error) {
+func packageSourceChecksums(userCacheDir string, dir string, compilerFlags []string, compilerEnv map[string]string) (map[string]string, error) {
+	pc, err := parseSources(userCacheDir, dir, compilerFlags, compilerEnv, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pc.checksums, nil
+}
+
+func parseSources(userCacheDir string, dir string, compilerFlags []string, compilerEnv map[string]string, hashes *hashIndex) (*parseContext, error) {
+	return parseSourcesFrom(userCacheDir, dir, dir, compilerFlags, compilerEnv, hashes)
+}
+
+// parseSourcesFrom parses the package in dir built by the go command run in buildDir, so that the main module
+// (or workspace) is the one of buildDir
+func parseSourcesFrom(userCacheDir string, buildDir string, dir string, compilerFlags []string, compilerEnv map[string]string, hashes *hashIndex) (*parseContext, error) {
+	absBuildDir, err := filepath.Abs(buildDir)
+	if err != nil {
+		return nil, err
+	}
 	absDir, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	pc := &parseContext{
-		checksums: map[string]string{},
-		packages:  map[string]bool{},
-		modules:   map[string]*moduleInfo{},
+	pc, err := newMainParseContext(absBuildDir, compilerFlags, compilerEnv, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
 	}
-	if err := parsePackage(pc, absDir); err != nil {
+	if pc.toolchain, err = resolveToolchain(userCacheDir, pc, compilerEnv); err != nil {
+		return nil, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
+	}
+	tags, err := lookupToolchainTags(userCacheDir, pc.toolchain, compilerEnv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
+	}
+	pc.build = newBuildContext(compilerFlags, compilerEnv, tags)
+	if pc.stdlib, err = loadStdlib(userCacheDir, pc.toolchain); err != nil {
 		return nil, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
 	}
 
-	return pc.checksums, nil
+	parsePackage(pc, absDir)
+	if err := pc.wait(); err != nil {
+		return nil, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
+	}
+
+	if err := addProfileChecksum(pc, absBuildDir, absDir, compilerFlags, compilerEnv); err != nil {
+		return nil, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
+	}
+	if err := addAssemblyIncludes(pc); err != nil {
+		return nil, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
+	}
+	if err := addCgoIncludes(pc, compilerEnv); err != nil {
+		return nil, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
+	}
+
+	return pc, nil
+}
+
+// asmIncludeRE matches '#include' directives of the Go assembler, which only takes quoted file names
+var asmIncludeRE = regexp.MustCompile("(?m)^[ \t]*#[ \t]*include[ \t]*(\"[^\"\n]*\"|`[^`\n]*`)")
+
+// addAssemblyIncludes adds the files included by Go assembly files. Included files may be anywhere, and they may
+// be listed as parts of other packages too, so this is done once all packages have been parsed.
+//
+// The assembler is run in the package directory and opens included files relative to it, whatever file includes
+// them. Files that are not found there are looked up in the include directories the go command passes to the
+// assembler: go_asm.h generated for the package, and textflag.h and others in the toolchain.
+func addAssemblyIncludes(pc *parseContext) error {
+	seen := map[string]bool{}
+	for _, filename := range slices.Sorted(maps.Keys(pc.checksums)) {
+		if filepath.Ext(filename) == ".s" {
+			if err := addAssemblyIncludesOf(pc, filepath.Dir(filename), filename, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func checksum(dir string, compilerFlags []string, compilerEnv map[string]string) (string, error) {
-	filesChecksums, err := packageSourceChecksums(dir)
+func addAssemblyIncludesOf(pc *parseContext, dir string, filename string, seen map[string]bool) error {
+	if seen[filename] {
+		return nil
+	}
+	seen[filename] = true
+
+	actualFileName, err := pc.overlay.path(filename)
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(actualFileName)
 	if err != nil {
+		return err
+	}
+
+	for _, m := range asmIncludeRE.FindAllSubmatch(contents, -1) {
+		name, err := strconv.Unquote(string(m[1]))
+		if err != nil || name == "" {
+			continue // The assembler reports it
+		}
+		included := filepath.Clean(absPathFrom(dir, name))
+
+		err = addChecksumUnlessExists(pc, included)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := addAssemblyIncludesOf(pc, dir, included, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addProfileChecksum adds the profile used for profile-guided optimization by the go command run in absDir.
+// Mirrors -pgo=auto, the default of the go command: default.pgo in the directory of the main package is used
+// if it exists. mainPackageDir is empty if the main package is not local.
+func addProfileChecksum(pc *parseContext, absDir string, mainPackageDir string, compilerFlags []string, compilerEnv map[string]string) error {
+	var profile string
+	switch pgo, _ := goFlag(compilerFlags, compilerEnv, "pgo"); pgo {
+	case "off":
+		return nil
+	case "", "auto":
+		if mainPackageDir == "" {
+			return nil
+		}
+		profile = filepath.Join(mainPackageDir, "default.pgo")
+	default:
+		profile = absPathFrom(absDir, pgo)
+	}
+
+	// The profile may be embedded into the program as well
+	err := addChecksumUnlessExists(pc, profile)
+	if os.IsNotExist(err) && profile == filepath.Join(mainPackageDir, "default.pgo") {
+		return nil
+	}
+	return err
+}
+
+// newMainParseContext finds the main module (or workspace) the go command uses in the directory, and whether
+// it is in vendor mode
+func newMainParseContext(absDir string, compilerFlags []string, compilerEnv map[string]string, hashes *hashIndex) (*parseContext, error) {
+	pc := newParseContext(hashes)
+
+	if overlayFileName, found := goFlag(compilerFlags, compilerEnv, "overlay"); found && overlayFileName != "" {
+		var err error
+		if pc.overlay, err = loadOverlay(absPathFrom(absDir, overlayFileName), absDir); err != nil {
+			return nil, err
+		}
+	}
+
+	goWorkFileName, err := findWorkspace(absDir, compilerEnv)
+	if err != nil {
+		return nil, err
+	}
+	if goWorkFileName != "" {
+		if pc.workspace, err = parseWorkspace(pc, goWorkFileName); err != nil {
+			return nil, err
+		}
+	}
+
+	// Mirrors the checks of -modfile by the go command, which takes relative paths from the package directory
+	if modFile, found := goFlag(compilerFlags, compilerEnv, "modfile"); found && modFile != "" {
+		if pc.workspace != nil {
+			return nil, fmt.Errorf("-modfile cannot be used in workspace mode")
+		}
+		if !strings.HasSuffix(modFile, ".mod") {
+			return nil, fmt.Errorf("-modfile=%s: file does not have .mod extension", modFile)
+		}
+		pc.modFile = absPathFrom(absDir, modFile)
+	}
+
+	if pc.mainModule, err = findModule(pc, absDir); err != nil {
+		return nil, err
+	}
+
+	if pc.vendorDir, err = findVendorDir(pc, compilerFlags, compilerEnv); err != nil {
+		return nil, err
+	}
+	if pc.vendorDir != "" {
+		if err := addChecksum(pc, filepath.Join(pc.vendorDir, "modules.txt")); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return pc, nil
+}
+
+// resolvePackageDir finds the directory of a package given on the command line, following the rules of 'go run':
+// paths that are absolute or start with '.' or '..' are directories, anything else is an import path resolved
+// from the current directory
+func resolvePackageDir(packagePath string, compilerFlags []string, compilerEnv map[string]string) (string, error) {
+	if gobuild.IsLocalImport(packagePath) || filepath.IsAbs(packagePath) {
+		return filepath.Abs(packagePath)
+	}
+	if isRemotePackage(packagePath) {
+		return "", fmt.Errorf("remote package %q has no local directory", packagePath)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	pc, err := newMainParseContext(wd, compilerFlags, compilerEnv, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve import path %q: %w", packagePath, err)
+	}
+
+	dir, local, err := resolveImport(pc, wd, packagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve import path %q: %w", packagePath, err)
+	}
+	if !local {
+		return "", fmt.Errorf("package %q is in a module that is not available locally: only packages of the main module, the workspace and local replacements can be run", packagePath)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("package %q is not found: directory %s does not exist", packagePath, dir)
+		}
 		return "", err
 	}
+	return dir, nil
+}
+
+// keyVersion is the version of the caching key scheme, printed by 'gr -hash'. It must be incremented whenever
+// the same source code might get a different key: inputs are added or removed, or their encoding changes.
+const keyVersion = 15
+
+// keyInputs are the inputs of the caching key. They are stored along with the builds, to find out why the key
+// has changed.
+type keyInputs struct {
+	MainPackage string            `json:"main_package"`
+	Files       map[string]string `json:"files"` // digests by relocatable path
+	Flags       []string          `json:"flags"`
+	Env         map[string]string `json:"env"`
+	Toolchain   toolchainInfo     `json:"toolchain"`
+	Cgo         *cgoInfo          `json:"cgo,omitempty"` // only if cgo is in effect for the build
+}
 
+func (in keyInputs) checksum() string {
 	// Poor man's canonicalization
-	bytes, err := json.Marshal([]any{
-		filesChecksums,
-		compilerFlags,
-		compilerEnv,
-	})
+	fields := []any{
+		in.MainPackage,
+		in.Files,
+		in.Flags,
+		in.Env,
+		in.Toolchain,
+	}
+	// Packages not using cgo do not depend on the system toolchain, so it is not a part of their keys at all
+	if in.Cgo != nil {
+		fields = append(fields, in.Cgo)
+	}
+	bytes, err := json.Marshal(fields)
 	if err != nil {
 		panic(fmt.Errorf("internal error: checksum information is not marshalable: %w", err))
 	}
@@ -349,5 +999,139 @@ func checksum(dir string, compilerFlags []string, compilerEnv map[string]string)
 		panic(fmt.Errorf("internal error: sha256.New().Write failed: %w", err))
 	}
 
-	return hex.EncodeToString(h.Sum(nil)), nil
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func checksumInputs(userCacheDir string, dir string, compilerFlags []string, compilerEnv map[string]string) (keyInputs, error) {
+	return checksumInputsFrom(userCacheDir, dir, dir, compilerFlags, compilerEnv)
+}
+
+// checksumInputsFrom is checksumInputs for a package built by the go command run in buildDir
+func checksumInputsFrom(userCacheDir string, buildDir string, dir string, compilerFlags []string, compilerEnv map[string]string) (keyInputs, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return keyInputs{}, err
+	}
+
+	hashes, err := loadHashIndex(userCacheDir, absDir)
+	if err != nil {
+		return keyInputs{}, err
+	}
+
+	pc, err := parseSourcesFrom(userCacheDir, buildDir, absDir, compilerFlags, compilerEnv, hashes)
+	if err != nil {
+		return keyInputs{}, err
+	}
+
+	if err := hashes.save(); err != nil {
+		return keyInputs{}, err
+	}
+
+	cgo, err := resolveCgo(userCacheDir, pc, compilerEnv)
+	if err != nil {
+		return keyInputs{}, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
+	}
+
+	files, err := relocatableChecksums(pc)
+	if err != nil {
+		return keyInputs{}, fmt.Errorf("failed to calculate checksum for %q: %w", dir, err)
+	}
+
+	return keyInputs{
+		MainPackage: relocatablePath(pc, absDir),
+		Files:       files,
+		Flags:       relocatableFlags(pc, compilerFlags),
+		Env:         relocatableEnv(pc, compilerEnv),
+		Toolchain:   pc.toolchain,
+		Cgo:         cgo,
+	}, nil
+}
+
+// relocatableChecksums returns the checksums of files by their relocatable paths, so that the key does not depend
+// on the location of the checkout
+func relocatableChecksums(pc *parseContext) (map[string]string, error) {
+	files := make(map[string]string, len(pc.checksums))
+	for filename, digest := range pc.checksums {
+		name := relocatablePath(pc, filename)
+		if _, exists := files[name]; exists {
+			return nil, fmt.Errorf("several files are named %q relative to their modules", name)
+		}
+		files[name] = digest
+	}
+	return files, nil
+}
+
+// relocatableFlags names files in compiler flags by relocatable paths. The contents of the files are in the key
+// already, and their absolute paths depend on the location of the checkout. The overlay is dropped altogether:
+// overlaid files are in the key, and overlays are often written to temporary files.
+func relocatableFlags(pc *parseContext, compilerFlags []string) []string {
+	out := slices.Clone(compilerFlags)
+	for i := 0; i+1 < len(out); i++ {
+		switch out[i] {
+		case "-modfile":
+			out[i+1] = relocatablePath(pc, out[i+1])
+		case "-pgo":
+			if out[i+1] != "auto" && out[i+1] != "off" {
+				out[i+1] = relocatablePath(pc, out[i+1])
+			}
+		case "-overlay":
+			out = slices.Delete(out, i, i+2)
+			i--
+		}
+	}
+	return out
+}
+
+// relocatableEnv names files in GOWORK and in GOFLAGS by relocatable paths, the same way relocatableFlags does
+func relocatableEnv(pc *parseContext, compilerEnv map[string]string) map[string]string {
+	out := maps.Clone(compilerEnv)
+	if gowork := out["GOWORK"]; filepath.IsAbs(gowork) {
+		out["GOWORK"] = relocatablePath(pc, gowork)
+	}
+	if goflags, found := out["GOFLAGS"]; found {
+		var flags []string
+		for _, f := range strings.Fields(goflags) {
+			k, v, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(f, "-"), "-"), "=")
+			switch {
+			case !hasValue:
+			case k == "modfile", k == "pgo" && v != "auto" && v != "off":
+				f = "-" + k + "=" + relocatablePath(pc, v)
+			case k == "overlay":
+				continue
+			}
+			flags = append(flags, f)
+		}
+		out["GOFLAGS"] = strings.Join(flags, " ")
+	}
+	return out
+}
+
+// relocatablePath names a file or a directory the way -trimpath does: by the path of the module it belongs to and
+// the path relative to the module root. Workspace files outside of every module are named relative to the workspace
+// directory, and anything else keeps its absolute path.
+//
+// Module paths neither contain ':' nor start with '/', so these names do not clash.
+func relocatablePath(pc *parseContext, path string) string {
+	pc.modulesMu.Lock()
+	defer pc.modulesMu.Unlock()
+
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if info := pc.modules[dir]; info != nil {
+			return info.path + ":" + relativeSlashPath(info.dir, path)
+		}
+		if pc.workspace != nil && dir == pc.workspace.dir {
+			return ":" + relativeSlashPath(pc.workspace.dir, path)
+		}
+		if filepath.Dir(dir) == dir {
+			return path
+		}
+	}
+}
+
+func relativeSlashPath(base, path string) string {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		panic(fmt.Errorf("internal error: %q is not inside of %q: %w", path, base, err))
+	}
+	return filepath.ToSlash(rel)
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"maps"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"testing"
@@ -12,10 +16,14 @@ import (
 )
 
 func testChecksums(t *testing.T, moduleDir string, expectedFilenames []string) {
+	testChecksumsWith(t, moduleDir, nil, map[string]string{}, expectedFilenames)
+}
+
+func testChecksumsWith(t *testing.T, moduleDir string, compilerFlags []string, compilerEnv map[string]string, expectedFilenames []string) {
 	prefix := must.OK1(os.Getwd()) + "/testdata/"
 
 	var actualFilenames []string
-	for name := range maps.Keys(must.OK1(packageSourceChecksums("testdata/" + moduleDir))) {
+	for name := range maps.Keys(must.OK1(packageSourceChecksums(t.TempDir(), "testdata/"+moduleDir, compilerFlags, compilerEnv))) {
 		actualFilenames = append(actualFilenames, strings.TrimPrefix(name, prefix))
 	}
 
@@ -70,3 +78,380 @@ func TestChecksumsInModule(t *testing.T) {
 		"in-module/inside/inside.go",
 	})
 }
+
+func TestChecksumsWorkspace(t *testing.T) {
+	testChecksums(t, "workspace/app", []string{
+		"workspace/app/go.mod",
+		"workspace/app/main.go",
+		"workspace/go.work",
+		"workspace/go.work.sum",
+		"workspace/lib/go.mod",
+		"workspace/lib/lib.go",
+		"workspace/patched/go.mod",
+		"workspace/patched/patched.go",
+	})
+}
+
+func TestChecksumsWorkspaceOff(t *testing.T) {
+	testChecksumsWith(t, "workspace/lib", nil, map[string]string{"GOWORK": "off"}, []string{
+		"workspace/lib/go.mod",
+		"workspace/lib/lib.go",
+	})
+}
+
+func TestChecksumsBuildConstraints(t *testing.T) {
+	testChecksums(t, "constraints", []string{
+		"constraints/go.mod",
+		"constraints/greeting_default.go",
+		"constraints/main.go",
+	})
+}
+
+func TestChecksumsBuildTags(t *testing.T) {
+	expected := []string{
+		"constraints/go.mod",
+		"constraints/greeting_extra.go",
+		"constraints/main.go",
+	}
+	testChecksumsWith(t, "constraints", []string{"-tags", "extra"}, map[string]string{}, expected)
+	testChecksumsWith(t, "constraints", nil, map[string]string{"GOFLAGS": "-tags=extra"}, expected)
+}
+
+func TestChecksumsReleaseTags(t *testing.T) {
+	// Release tags are the ones of the selected toolchain, not of the one gr is built with.
+	//
+	// The memos of the toolchain are seeded so that it is not downloaded.
+	cacheDir := t.TempDir()
+	_, local := must.OK2(lookupLocalToolchain(cacheDir))
+	must.OK(writeExperimentTags(toolchainMemoFile(cacheDir, "experiments", "go1.30.0", runtime.GOOS, runtime.GOARCH), []string{}))
+	must.OK(writeStdlib(toolchainMemoFile(cacheDir, "stdlib", "go1.30.0"), must.OK1(listStdlib(local.GOROOT))))
+
+	prefix := must.OK1(os.Getwd()) + "/testdata/"
+	var actualFilenames []string
+	for name := range maps.Keys(must.OK1(packageSourceChecksums(cacheDir, "testdata/release-tags", nil, map[string]string{"GOTOOLCHAIN": "go1.30.0"}))) {
+		actualFilenames = append(actualFilenames, strings.TrimPrefix(name, prefix))
+	}
+	sort.Strings(actualFilenames)
+	assert.Equal(t, []string{
+		"release-tags/future.go",
+		"release-tags/go.mod",
+		"release-tags/main.go",
+	}, actualFilenames)
+
+	testChecksumsWith(t, "release-tags", nil, map[string]string{"GOTOOLCHAIN": "local"}, []string{
+		"release-tags/go.mod",
+		"release-tags/main.go",
+	})
+}
+
+func TestChecksumsGOOS(t *testing.T) {
+	_, err := packageSourceChecksums(t.TempDir(), "testdata/constraints", nil, map[string]string{"GOOS": "windows", "GOARCH": "amd64"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `package "drozd.in/windows-only" is outside of every module`)
+}
+
+func TestChecksumsModFile(t *testing.T) {
+	expected := []string{
+		"modfile/greeting/go.mod",
+		"modfile/greeting/greeting.go",
+		"modfile/main.go",
+		"modfile/tools.mod",
+	}
+	testChecksumsWith(t, "modfile", []string{"-modfile", must.OK1(filepath.Abs("testdata/modfile/tools.mod"))}, map[string]string{}, expected)
+	testChecksumsWith(t, "modfile", nil, map[string]string{"GOFLAGS": "-modfile=tools.mod"}, expected)
+
+	// The flag does not make the key depend on the location of the checkout
+	inputs := must.OK1(checksumInputs(t.TempDir(), "testdata/modfile", []string{"-modfile", must.OK1(filepath.Abs("testdata/modfile/tools.mod"))}, map[string]string{}))
+	assert.Equal(t, []string{"-modfile", "testdata/modfile:tools.mod"}, inputs.Flags)
+
+	_, err := packageSourceChecksums(t.TempDir(), "testdata/modfile", []string{"-modfile", "tools.txt"}, map[string]string{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "-modfile=tools.txt: file does not have .mod extension")
+
+	_, err = packageSourceChecksums(t.TempDir(), "testdata/workspace/app", []string{"-modfile", "tools.mod"}, map[string]string{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "-modfile cannot be used in workspace mode")
+}
+
+func TestChecksumsRelocatableEnv(t *testing.T) {
+	cacheDir := t.TempDir()
+	overlay := filepath.Join(t.TempDir(), "overlay.json")
+	must.OK(os.WriteFile(overlay, []byte(`{"Replace":{}}`), 0o644))
+
+	var inputs []keyInputs
+	for _, checkout := range []string{"one", "two"} {
+		dir := filepath.Join(t.TempDir(), checkout)
+		must.OK(os.CopyFS(filepath.Join(dir, "modfile"), os.DirFS("testdata/modfile")))
+		must.OK(os.CopyFS(filepath.Join(dir, "workspace"), os.DirFS("testdata/workspace")))
+
+		modFileInputs := must.OK1(checksumInputs(cacheDir, filepath.Join(dir, "modfile"), nil, map[string]string{
+			"GOFLAGS": "-tags=extra --modfile=" + filepath.Join(dir, "modfile/tools.mod") + " -overlay=" + overlay,
+		}))
+		assert.Equal(t, "-tags=extra -modfile=testdata/modfile:tools.mod", modFileInputs.Env["GOFLAGS"])
+
+		workspaceInputs := must.OK1(checksumInputs(cacheDir, filepath.Join(dir, "workspace/app"), nil, map[string]string{
+			"GOWORK": filepath.Join(dir, "workspace/go.work"),
+		}))
+		assert.Equal(t, ":go.work", workspaceInputs.Env["GOWORK"])
+
+		inputs = append(inputs, modFileInputs, workspaceInputs)
+	}
+
+	// The key depends neither on the location of the checkout, nor on the location of the toolchain with -portable
+	assert.Equal(t, inputs[0].checksum(), inputs[2].checksum())
+	assert.Equal(t, inputs[1].checksum(), inputs[3].checksum())
+	assert.Equal(t, must.OK1(trimKeyInputs(inputs[0])).checksum(), must.OK1(trimKeyInputs(inputs[2])).checksum())
+	assert.Equal(t, must.OK1(trimKeyInputs(inputs[1])).checksum(), must.OK1(trimKeyInputs(inputs[3])).checksum())
+}
+
+func TestChecksumsOverlay(t *testing.T) {
+	overlayFlags := []string{"-overlay", must.OK1(filepath.Abs("testdata/overlay/overlay.json"))}
+	testChecksumsWith(t, "overlay", overlayFlags, map[string]string{}, []string{
+		"overlay/go.mod",
+		"overlay/greeting.go",
+		"overlay/main.go",
+		"overlay/question.go",
+	})
+
+	// Overlaid files are hashed by their names in the package, so the overlay itself is not in the key
+	checksums := must.OK1(packageSourceChecksums(t.TempDir(), "testdata/overlay", overlayFlags, map[string]string{}))
+	assert.Equal(t, must.OK1(hashFile("testdata/overlay/replacements/greeting.go.txt")), checksums[must.OK1(filepath.Abs("testdata/overlay/greeting.go"))])
+	inputs := must.OK1(checksumInputs(t.TempDir(), "testdata/overlay", overlayFlags, map[string]string{}))
+	assert.Equal(t, []string{}, inputs.Flags)
+}
+
+func TestChecksumsPGO(t *testing.T) {
+	testChecksums(t, "pgo", []string{
+		"pgo/default.pgo",
+		"pgo/go.mod",
+		"pgo/main.go",
+	})
+	testChecksumsWith(t, "pgo", []string{"-pgo", "off"}, map[string]string{}, []string{
+		"pgo/go.mod",
+		"pgo/main.go",
+	})
+	testChecksumsWith(t, "pgo", nil, map[string]string{"GOFLAGS": "-pgo=other.pgo"}, []string{
+		"pgo/go.mod",
+		"pgo/main.go",
+		"pgo/other.pgo",
+	})
+	testChecksumsWith(t, "basic", []string{"-pgo", "auto"}, map[string]string{}, []string{
+		"basic/basic.go",
+		"basic/go.mod",
+	})
+
+	inputs := must.OK1(checksumInputs(t.TempDir(), "testdata/pgo", []string{"-pgo", must.OK1(filepath.Abs("testdata/pgo/other.pgo"))}, map[string]string{}))
+	assert.Equal(t, []string{"-pgo", "testdata/pgo:other.pgo"}, inputs.Flags)
+}
+
+func TestChecksumsSyso(t *testing.T) {
+	testChecksumsWith(t, "syso", nil, map[string]string{"GOOS": "linux", "GOARCH": "amd64"}, []string{
+		"syso/go.mod",
+		"syso/main.go",
+		"syso/resource_linux.syso",
+	})
+	testChecksumsWith(t, "syso", nil, map[string]string{"GOOS": "windows", "GOARCH": "amd64"}, []string{
+		"syso/go.mod",
+		"syso/main.go",
+		"syso/resource_windows.syso",
+	})
+}
+
+func TestChecksumsSwig(t *testing.T) {
+	testChecksums(t, "swig", []string{
+		"swig/counter.hpp",
+		"swig/counter.swigcxx",
+		"swig/go.mod",
+		"swig/greeting.h",
+		"swig/greeting.swig",
+		"swig/main.go",
+	})
+}
+
+func TestChecksumsAssemblyIncludes(t *testing.T) {
+	testChecksumsWith(t, "asm-include", nil, map[string]string{"GOOS": "linux", "GOARCH": "amd64"}, []string{
+		"asm-include/answer.inc",
+		"asm-include/answer_amd64.s",
+		"asm-include/go.mod",
+		"asm-include/include/answer.h",
+		"asm-include/main.go",
+	})
+	testChecksumsWith(t, "asm-include", nil, map[string]string{"GOOS": "linux", "GOARCH": "arm64"}, []string{
+		"asm-include/go.mod",
+		"asm-include/main.go",
+	})
+}
+
+func TestChecksumsDotlessModules(t *testing.T) {
+	testChecksums(t, "dotless", []string{
+		"dotless/go.mod",
+		"dotless/greeting/greeting.go",
+		"dotless/main.go",
+		"dotless/x/go.mod",
+		"dotless/x/x.go",
+	})
+}
+
+func TestChecksumsCgoIncludes(t *testing.T) {
+	common := []string{
+		"cgo-include/app/main.go",
+		"cgo-include/app/twice.c",
+		"cgo-include/common/factor.h",
+		"cgo-include/common/twice.h",
+		"cgo-include/go.mod",
+	}
+	testChecksumsWith(t, "cgo-include/app", nil, map[string]string{"CGO_ENABLED": "1", "GOOS": "linux"},
+		append([]string{"cgo-include/include/greeting.h", "cgo-include/include/greeting_text.h"}, common...))
+	testChecksumsWith(t, "cgo-include/app", nil, map[string]string{"CGO_ENABLED": "1", "GOOS": "windows"},
+		append([]string{"cgo-include/windows/greeting.h"}, common...))
+
+	// Files importing "C" are not built without cgo, and C sources only make the build fail
+	testChecksumsWith(t, "cgo-include/app", nil, map[string]string{"CGO_ENABLED": "0"}, []string{
+		"cgo-include/app/twice.c",
+		"cgo-include/go.mod",
+	})
+
+	// Headers outside of modules belong to the system, wherever they are found
+	checkout, system := t.TempDir(), t.TempDir()
+	must.OK(os.CopyFS(checkout, os.DirFS("testdata/cgo-include")))
+	must.OK(os.Rename(filepath.Join(checkout, "include/greeting.h"), filepath.Join(system, "greeting.h")))
+	must.OK(os.Rename(filepath.Join(checkout, "include/greeting_text.h"), filepath.Join(system, "greeting_text.h")))
+
+	var files []string
+	for name := range must.OK1(packageSourceChecksums(t.TempDir(), filepath.Join(checkout, "app"), nil, map[string]string{
+		"CGO_ENABLED": "1",
+		"GOOS":        "linux",
+		"CGO_CFLAGS":  "-I" + system,
+	})) {
+		files = append(files, strings.TrimPrefix(name, checkout+"/"))
+	}
+	sort.Strings(files)
+	assert.Equal(t, []string{"app/main.go", "app/twice.c", "common/factor.h", "common/twice.h", "go.mod"}, files)
+}
+
+func TestChecksumsVendor(t *testing.T) {
+	testChecksums(t, "vendor", []string{
+		"vendor/go.mod",
+		"vendor/main.go",
+		"vendor/vendor/drozd.in/vendored/vendored.go",
+		"vendor/vendor/modules.txt",
+	})
+}
+
+func TestResolveImportVendorStdlib(t *testing.T) {
+	pc := must.OK1(newMainParseContext(must.OK1(filepath.Abs("testdata/vendor")), nil, map[string]string{}, nil))
+	assert.NotZero(t, pc.vendorDir)
+
+	// Dotless paths missing from the vendor directory may be in the standard library of a newer toolchain
+	dir, local := must.OK2(resolveImport(pc, pc.mainModule.dir, "newstd/pkg"))
+	assert.Equal(t, "", dir)
+	assert.False(t, local)
+
+	_, _, err := resolveImport(pc, pc.mainModule.dir, "example.com/missing")
+	assert.EqualError(t, err, `package "example.com/missing" is not found in vendor directory "`+pc.vendorDir+`"`)
+}
+
+func TestChecksumsVendorDisabled(t *testing.T) {
+	expected := []string{
+		"vendor/go.mod",
+		"vendor/main.go",
+	}
+	testChecksumsWith(t, "vendor", []string{"-mod", "mod"}, map[string]string{}, expected)
+	testChecksumsWith(t, "vendor", nil, map[string]string{"GOFLAGS": "-mod=readonly"}, expected)
+}
+
+// generateModuleTree creates a module with the main package importing a binary tree of packages.
+// Every package consists of several source files and an embedded asset.
+func generateModuleTree(tb testing.TB, packages, filesPerPackage int) string {
+	dir := tb.TempDir()
+	must.OK(os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module drozd.in/tree\n\ngo 1.23\n"), 0o644))
+
+	asset := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	body := strings.Repeat("\tx = append(x, len(x))\n", 200)
+
+	for p := range packages {
+		pkgDir := filepath.Join(dir, fmt.Sprintf("p%d", p))
+		must.OK(os.Mkdir(pkgDir, 0o755))
+		must.OK(os.WriteFile(filepath.Join(pkgDir, "asset.bin"), asset, 0o644))
+
+		var imports string
+		for _, child := range []int{2*p + 1, 2*p + 2} {
+			if child < packages {
+				imports += fmt.Sprintf("\t_ \"drozd.in/tree/p%d\"\n", child)
+			}
+		}
+
+		for f := range filesPerPackage {
+			src := fmt.Sprintf("package p%d\n\nimport (\n\t_ \"embed\"\n%s)\n\n", p, imports)
+			if f == 0 {
+				src += "//go:embed asset.bin\nvar asset []byte\n\n"
+			}
+			src += fmt.Sprintf("func f%d(x []int) []int {\n%s\treturn x\n}\n", f, body)
+			must.OK(os.WriteFile(filepath.Join(pkgDir, fmt.Sprintf("f%d.go", f)), []byte(src), 0o644))
+		}
+	}
+
+	must.OK(os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nimport _ \"drozd.in/tree/p0\"\n\nfunc main() {}\n"), 0o644))
+	return dir
+}
+
+func TestChecksumsDeterministic(t *testing.T) {
+	dir := generateModuleTree(t, 50, 3)
+
+	cacheDir := t.TempDir()
+	expected := must.OK1(packageSourceChecksums(cacheDir, dir, nil, map[string]string{}))
+	assert.Equal(t, 1+1+50*(3+1), len(expected)) // go.mod, main.go, sources and assets
+
+	for range 10 {
+		assert.Equal(t, expected, must.OK1(packageSourceChecksums(cacheDir, dir, nil, map[string]string{})))
+	}
+}
+
+func BenchmarkPackageSourceChecksums(b *testing.B) {
+	dir := generateModuleTree(b, 300, 5)
+	cacheDir := b.TempDir()
+
+	for _, parallelism := range []int{1, parseParallelism} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			defer func(p int) { parseParallelism = p }(parseParallelism)
+			parseParallelism = parallelism
+
+			for range b.N {
+				must.OK1(packageSourceChecksums(cacheDir, dir, nil, map[string]string{}))
+			}
+		})
+	}
+}
+
+func TestResolvePackageDir(t *testing.T) {
+	root := must.OK1(filepath.Abs("testdata"))
+	wd := must.OK1(os.Getwd())
+	t.Cleanup(func() { must.OK(os.Chdir(wd)) })
+
+	for _, tc := range []struct {
+		wd, packagePath, dir, err string
+	}{
+		{wd: "ext", packagePath: ".", dir: "ext"},
+		{wd: "ext", packagePath: "../basic", dir: "basic"},
+		{wd: "ext", packagePath: root + "/basic", dir: "basic"},
+		{wd: "ext", packagePath: "drozd.in/ext", dir: "ext"},
+		{wd: "in-module/inside", packagePath: "drozd.in/in-module", err: `package "drozd.in/in-module" is outside of every module`},
+		{wd: "in-module", packagePath: "drozd.in/in-module/lala/inside", dir: "in-module/inside"},
+		{wd: "workspace/lib", packagePath: "drozd.in/app", dir: "workspace/app"},
+		{wd: "vendor", packagePath: "drozd.in/vendored", dir: "vendor/vendor/drozd.in/vendored"},
+		{wd: "ext", packagePath: "drozd.in/ext/nope", err: `package "drozd.in/ext/nope" is not found`},
+		{wd: "ext", packagePath: "github.com/dottedmag/must", err: `package "github.com/dottedmag/must" is in a module that is not available locally`},
+	} {
+		t.Run(tc.wd+":"+tc.packagePath, func(t *testing.T) {
+			must.OK(os.Chdir(filepath.Join(root, tc.wd)))
+			dir, err := resolvePackageDir(tc.packagePath, nil, map[string]string{})
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join(root, tc.dir), dir)
+		})
+	}
+}
@@ -4,11 +4,33 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 )
 
-func usage() {
-	fmt.Fprintln(flag.CommandLine.Output(), "Usage: gr [go build opts] <pkg> [arguments]:")
-	flag.PrintDefaults()
+func usage(flags *flag.FlagSet, command string) {
+	switch command {
+	case "":
+		fmt.Fprintln(flags.Output(), "Usage: gr [go build opts] <pkg> [arguments]")
+		fmt.Fprintln(flags.Output(), "       gr -tool [go build opts] <name> [arguments]")
+		fmt.Fprintln(flags.Output(), "       gr -which [go build opts] <pkg>")
+		fmt.Fprintln(flags.Output(), "       gr -explain [go build opts] <pkg>")
+		fmt.Fprintln(flags.Output(), "       gr -deps [-format text|json|make|dot] [-target <name>] [go build opts] <pkg>")
+		fmt.Fprintln(flags.Output(), "       gr -hash [-portable] [go build opts] <pkg>")
+		fmt.Fprintln(flags.Output(), "       gr -cache <command> [arguments]")
+	case "tool":
+		fmt.Fprintln(flags.Output(), "Usage: gr -tool [go build opts] <name> [arguments]")
+		fmt.Fprintln(flags.Output(), "       gr -tool")
+	case "hash":
+		fmt.Fprintln(flags.Output(), "Usage: gr -hash [-portable] [go build opts] <pkg>")
+	case "deps":
+		fmt.Fprintln(flags.Output(), "Usage: gr -deps [-format text|json|make|dot] [-target <name>] [go build opts] <pkg>")
+	default:
+		fmt.Fprintf(flags.Output(), "Usage: gr -%s [go build opts] <pkg>\n", command)
+	}
+	fmt.Fprintln(flags.Output())
+	flags.PrintDefaults()
 }
 
 type unsupportedFlagT struct{}
@@ -29,20 +51,51 @@ type boolFlag struct {
 }
 
 type stringFlag struct {
-	Flag  string
-	Value string
+	Flag   string
+	Values []string // Allowed values, if restricted
+	Path   bool     // Relative paths are made absolute, as the go command is run in another directory
+	Names  []string // Values of path flags that are not paths
+	Value  string
+}
+
+// goFlag returns the value of a 'go build' string flag, as specified on the command line, or,
+// failing that, in GOFLAGS environment variable.
+func goFlag(compilerFlags []string, compilerEnv map[string]string, name string) (string, bool) {
+	for i := len(compilerFlags) - 1; i >= 0; i-- {
+		if compilerFlags[i] == "-"+name && i+1 < len(compilerFlags) {
+			return compilerFlags[i+1], true
+		}
+	}
+
+	var val string
+	var found bool
+	for _, f := range strings.Fields(compilerEnv["GOFLAGS"]) {
+		k, v, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(f, "-"), "-"), "=")
+		if k == name && hasValue {
+			val, found = v, true
+		}
+	}
+	return val, found
 }
 
 type parsedCLI struct {
 	compilerFlags []string
 	compilerEnv   map[string]string
+	gc            gcSettings
 
 	packagePath string
 	runArgs     []string
 	debug       bool
 }
 
-func parseCLI() (parsedCLI, bool) {
+// parseCLI parses the arguments of running a package, or of a command that takes the same arguments
+// (without the arguments of the package). Commands may define their own flags in commandFlags.
+func parseCLI(command string, args []string, commandFlags func(flags *flag.FlagSet)) (parsedCLI, bool) {
+	flags := flag.NewFlagSet("gr", flag.ExitOnError)
+	if commandFlags != nil {
+		commandFlags(flags)
+	}
+
 	boolFlags := []*boolFlag{
 		{Flag: "race"},
 		{Flag: "msan"},
@@ -58,84 +111,79 @@ func parseCLI() (parsedCLI, bool) {
 		{Flag: "asmflags"},
 		{Flag: "gcflags"},
 		{Flag: "ldflags"},
+		{Flag: "mod", Values: []string{"mod", "readonly", "vendor"}},
+		{Flag: "modfile", Path: true},
+		{Flag: "overlay", Path: true},
+		{Flag: "pgo", Path: true, Names: []string{"auto", "off"}},
+		{Flag: "tags"},
 	}
 
 	// These options are either useless for 'go run' replacement, or not trivial to implement.
 	// Instead of producing silent hard-to-debug mistakes, reject them.
 	for _, f := range []string{
 		"a", "C", "n", "p", "buildmode", "buildvcs", "compiler", "gccgoflags", "installsuffix", "linkshared",
-		"mod", "modcacherw", "modfile", "overlay", "pgo", "pkgdir", "tags", "trimpath", "toolexec",
+		"modcacherw", "pkgdir", "trimpath", "toolexec",
 	} {
-		flag.Var(unsupportedFlag, f, "(not yet) supported")
+		flags.Var(unsupportedFlag, f, "(not yet) supported")
 	}
 
 	for _, f := range boolFlags {
-		flag.BoolVar(&f.Value, f.Flag, false, "as in 'go build'")
+		flags.BoolVar(&f.Value, f.Flag, false, "as in 'go build'")
 	}
 	for _, f := range stringFlags {
-		flag.StringVar(&f.Value, f.Flag, "", "as in 'go build'")
+		flags.StringVar(&f.Value, f.Flag, "", "as in 'go build'")
 	}
 
 	var debug bool
-	flag.BoolVar(&debug, "debug", false, "enable debug output")
+	flags.BoolVar(&debug, "debug", false, "enable debug output")
 
-	flag.Usage = usage
-	flag.Parse()
+	flags.Usage = func() { usage(flags, command) }
+	_ = flags.Parse(args) // Exits on error
 
-	if flag.NArg() == 0 {
-		usage()
+	// Tools are run with arguments, the same way as packages
+	if flags.NArg() == 0 || command != "" && command != "tool" && flags.NArg() > 1 {
+		flags.Usage()
 		return parsedCLI{}, false
 	}
 
+	for _, f := range stringFlags {
+		if len(f.Values) > 0 && f.Value != "" && !slices.Contains(f.Values, f.Value) {
+			fmt.Fprintf(os.Stderr, "gr: invalid value %q for flag -%s: must be one of %s\n", f.Value, f.Flag, strings.Join(f.Values, ", "))
+			return parsedCLI{}, false
+		}
+	}
+
 	out := parsedCLI{
-		packagePath: flag.Arg(0),
-		runArgs:     flag.Args()[1:],
+		packagePath: flags.Arg(0),
+		runArgs:     flags.Args()[1:],
 		debug:       debug,
-		compilerEnv: map[string]string{},
 	}
 	for _, f := range boolFlags {
 		if f.Value {
 			out.compilerFlags = append(out.compilerFlags, "-"+f.Flag)
 		}
 	}
+	var err error
 	for _, f := range stringFlags {
-		if f.Value != "" {
-			out.compilerFlags = append(out.compilerFlags, "-"+f.Flag, f.Value)
+		if f.Value == "" {
+			continue
+		}
+		if f.Path && !slices.Contains(f.Names, f.Value) {
+			if f.Value, err = filepath.Abs(f.Value); err != nil {
+				fmt.Fprintf(os.Stderr, "gr: invalid value %q for flag -%s: %v\n", f.Value, f.Flag, err)
+				return parsedCLI{}, false
+			}
 		}
+		out.compilerFlags = append(out.compilerFlags, "-"+f.Flag, f.Value)
 	}
 
-	// These variables influence the compiler, so they should influence the cache key too
-	for _, env := range []string{
-		"AR",
-		"CC",
-		"CGO_CFLAGS",
-		"CGO_CPPFLAGS",
-		"CGO_CXXFLAGS",
-		"CGO_ENABLED",
-		"CGO_FFLAGS",
-		"CGO_LDFLAGS",
-		"CXX",
-		"GCCGO",
-		"GO111MODULE",
-		"GOARCH",
-		"GOARM64",
-		"GODEBUG",
-		"GOEXE",
-		"GOEXPERIMENT",
-		"GOFLAGS",
-		"GOHOSTARCH",
-		"GOHOSTOS",
-		"GOMOD",
-		"GOOS",
-		"GOPATH",
-		"GOROOT",
-		"GOTOOLCHAIN",
-		"GOTOOLDIR",
-		"GOVERSION",
-	} {
-		if val, exists := os.LookupEnv(env); exists {
-			out.compilerEnv[env] = val
-		}
+	if out.compilerEnv, err = compilerEnvironment(); err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't run: %v\n", err)
+		return parsedCLI{}, false
+	}
+	if out.gc, err = gcSettingsFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't run: %v\n", err)
+		return parsedCLI{}, false
 	}
 
 	return out, true
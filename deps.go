@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//
+// 'gr -deps' prints the files the executable of a package depends on: the same files the caching key is
+// calculated from. Build systems use it to rebuild the outputs of generators run by 'gr' only when needed.
+//
+
+type depsPackage struct {
+	Dir        string   `json:"dir"`
+	ImportPath string   `json:"import_path"`
+	Imports    []string `json:"imports"` // directories of local packages
+}
+
+type depsInfo struct {
+	Package  string        `json:"package"`
+	Files    []string      `json:"files"`
+	Packages []depsPackage `json:"packages"` // local packages, sorted by directory
+}
+
+func depsCommand(args []string) int {
+	var format, target string
+	cli, ok := parseCLI("deps", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&format, "format", "text", "output format: text, json, make or dot")
+		flags.StringVar(&target, "target", "", "target of the rule in make format (default: the package)")
+	})
+	if !ok {
+		return 2
+	}
+
+	var write func(w io.Writer, deps depsInfo) error
+	switch format {
+	case "text":
+		write = writeDepsText
+	case "json":
+		write = func(w io.Writer, deps depsInfo) error { return writeJSON(w, deps) }
+	case "make":
+		if target == "" {
+			target = cli.packagePath
+		}
+		write = func(w io.Writer, deps depsInfo) error { return writeDepsMake(w, target, deps) }
+	case "dot":
+		write = writeDepsDot
+	default:
+		fmt.Fprintf(os.Stderr, "gr: invalid value %q for flag -format: must be one of text, json, make, dot\n", format)
+		return 2
+	}
+
+	cacheDir, err := userCacheDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't run: %v\n", err)
+		return 255
+	}
+
+	absPackagePath, err := resolvePackageDir(cli.packagePath, cli.compilerFlags, cli.compilerEnv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't find package %q: %v\n", cli.packagePath, err)
+		return 255
+	}
+
+	deps, err := packageDeps(cacheDir, absPackagePath, cli.compilerFlags, cli.compilerEnv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't list dependencies of package %q: %v\n", cli.packagePath, err)
+		return 255
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	err = write(w, deps)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: failed to print dependencies: %v\n", err)
+		return 255
+	}
+	return 0
+}
+
+func packageDeps(userCacheDir string, dir string, compilerFlags []string, compilerEnv map[string]string) (depsInfo, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return depsInfo{}, err
+	}
+
+	hashes, err := loadHashIndex(userCacheDir, absDir)
+	if err != nil {
+		return depsInfo{}, err
+	}
+
+	pc, err := parseSources(userCacheDir, absDir, compilerFlags, compilerEnv, hashes)
+	if err != nil {
+		return depsInfo{}, err
+	}
+
+	if err := hashes.save(); err != nil {
+		return depsInfo{}, err
+	}
+
+	out := depsInfo{
+		Package:  absDir,
+		Files:    slices.Sorted(maps.Keys(pc.checksums)),
+		Packages: []depsPackage{},
+	}
+	for _, packageDir := range slices.Sorted(maps.Keys(pc.imports)) {
+		out.Packages = append(out.Packages, depsPackage{
+			Dir:        packageDir,
+			ImportPath: packageImportPath(pc, packageDir),
+			Imports:    append([]string{}, pc.imports[packageDir]...),
+		})
+	}
+	return out, nil
+}
+
+// packageImportPath finds the import path of a local package from its directory
+func packageImportPath(pc *parseContext, dir string) string {
+	if pc.vendorDir != "" && packageInsideOf(dir, pc.vendorDir) {
+		return relativeSlashPath(pc.vendorDir, dir)
+	}
+
+	modulePath, rel, found := strings.Cut(relocatablePath(pc, dir), ":")
+	switch {
+	case !found || modulePath == "": // Not in a module
+		return dir
+	case rel == ".":
+		return modulePath
+	default:
+		return modulePath + "/" + rel
+	}
+}
+
+func writeDepsText(w io.Writer, deps depsInfo) error {
+	for _, f := range deps.Files {
+		if _, err := fmt.Fprintln(w, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDepsMake writes a rule in the format of depfiles produced by 'gcc -M', understood by Make and Ninja
+func writeDepsMake(w io.Writer, target string, deps depsInfo) error {
+	if _, err := fmt.Fprintf(w, "%s:", makeEscape(target)); err != nil {
+		return err
+	}
+	for _, f := range deps.Files {
+		if _, err := fmt.Fprintf(w, " \\\n  %s", makeEscape(f)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+var makeEscaper = strings.NewReplacer("$", "$$", "#", `\#`, " ", `\ `)
+
+func makeEscape(s string) string {
+	return makeEscaper.Replace(s)
+}
+
+// writeDepsDot writes the graph of local packages in the DOT language of Graphviz
+func writeDepsDot(w io.Writer, deps depsInfo) error {
+	importPaths := map[string]string{}
+	for _, p := range deps.Packages {
+		importPaths[p.Dir] = p.ImportPath
+	}
+
+	if _, err := fmt.Fprintln(w, "digraph deps {"); err != nil {
+		return err
+	}
+	for _, p := range deps.Packages {
+		if _, err := fmt.Fprintf(w, "\t%s;\n", strconv.Quote(p.ImportPath)); err != nil {
+			return err
+		}
+	}
+	for _, p := range deps.Packages {
+		for _, imp := range p.Imports {
+			if _, err := fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote(p.ImportPath), strconv.Quote(importPaths[imp])); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
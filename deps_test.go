@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func TestPackageDeps(t *testing.T) {
+	root := must.OK1(filepath.Abs("testdata/workspace"))
+	deps := must.OK1(packageDeps(t.TempDir(), "testdata/workspace/app", nil, map[string]string{}))
+
+	var files []string
+	for _, f := range deps.Files {
+		files = append(files, strings.TrimPrefix(f, root+"/"))
+	}
+	assert.Equal(t, []string{
+		"app/go.mod", "app/main.go", "go.work", "go.work.sum",
+		"lib/go.mod", "lib/lib.go", "patched/go.mod", "patched/patched.go",
+	}, files)
+
+	assert.Equal(t, []depsPackage{
+		{Dir: root + "/app", ImportPath: "drozd.in/app", Imports: []string{root + "/lib", root + "/patched"}},
+		{Dir: root + "/lib", ImportPath: "drozd.in/lib", Imports: []string{}},
+		{Dir: root + "/patched", ImportPath: "drozd.in/patched", Imports: []string{}},
+	}, deps.Packages)
+}
+
+func TestWriteDeps(t *testing.T) {
+	deps := depsInfo{
+		Package: "/src/cmd/gen",
+		Files:   []string{"/src/cmd/gen/main.go", "/src/my lib/$#.go"},
+		Packages: []depsPackage{
+			{Dir: "/src/cmd/gen", ImportPath: "example.com/cmd/gen", Imports: []string{"/src/my lib"}},
+			{Dir: "/src/my lib", ImportPath: "example.com/my lib", Imports: []string{}},
+		},
+	}
+
+	var buf bytes.Buffer
+	must.OK(writeDepsMake(&buf, "gen/out.go", deps))
+	assert.Equal(t, "gen/out.go: \\\n  /src/cmd/gen/main.go \\\n  /src/my\\ lib/$$\\#.go\n", buf.String())
+
+	buf.Reset()
+	must.OK(writeDepsDot(&buf, deps))
+	assert.Equal(t, `digraph deps {
+	"example.com/cmd/gen";
+	"example.com/my lib";
+	"example.com/cmd/gen" -> "example.com/my lib";
+}
+`, buf.String())
+}
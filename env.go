@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// These variables influence the compiler, so they should influence the cache key too.
+//
+// Every variable described by 'go help environment' must be listed either here or in ignoredEnvVars.
+var compilerEnvVars = []string{
+	// General-purpose
+	"GCCGO",
+	"GO111MODULE",
+	"GOARCH",
+	"GODEBUG",
+	"GOFLAGS",
+	"GOOS",
+	"GOPATH",
+	"GOROOT",
+	"GOTOOLCHAIN",
+	"GOWORK",
+
+	// cgo
+	"AR",
+	"CC",
+	"CGO_CFLAGS",
+	"CGO_CPPFLAGS",
+	"CGO_CXXFLAGS",
+	"CGO_ENABLED",
+	"CGO_FFLAGS",
+	"CGO_LDFLAGS",
+	"CXX",
+	"FC",
+	"PKG_CONFIG",
+
+	// Architecture-specific
+	"GO386",
+	"GOAMD64",
+	"GOARM",
+	"GOARM64",
+	"GOMIPS",
+	"GOMIPS64",
+	"GOPPC64",
+	"GORISCV64",
+	"GOWASM",
+
+	// Special-purpose
+	"GCCGOTOOLDIR",
+	"GOEXPERIMENT",
+	"GOFIPS140",
+	"GO_EXTLINK_ENABLED",
+}
+
+var ignoredEnvVars = []string{
+	// Locations of caches and installed binaries
+	"GOBIN",
+	"GOCACHE",
+	"GOCACHEPROG",
+	"GOMODCACHE",
+	"GOTMPDIR",
+	"GOCOVERDIR",
+
+	// Contents of GOENV file are merged into the environment
+	"GOENV",
+
+	// Module downloads are verified by go.sum, so their origin does not matter
+	"GOAUTH",
+	"GOINSECURE",
+	"GONOPROXY",
+	"GONOSUMDB",
+	"GOPRIVATE",
+	"GOPROXY",
+	"GOSUMDB",
+	"GOVCS",
+	"GIT_ALLOW_PROTOCOL",
+
+	// These only decide whether the build fails
+	"CGO_CFLAGS_ALLOW",
+	"CGO_CFLAGS_DISALLOW",
+	"CGO_CPPFLAGS_ALLOW",
+	"CGO_CPPFLAGS_DISALLOW",
+	"CGO_CXXFLAGS_ALLOW",
+	"CGO_CXXFLAGS_DISALLOW",
+	"CGO_FFLAGS_ALLOW",
+	"CGO_FFLAGS_DISALLOW",
+	"CGO_LDFLAGS_ALLOW",
+	"CGO_LDFLAGS_DISALLOW",
+
+	// Not read from the environment
+	"GOEXE",
+	"GOGCCFLAGS",
+	"GOHOSTARCH",
+	"GOHOSTOS",
+	"GOMOD",
+	"GOTELEMETRY",
+	"GOTELEMETRYDIR",
+	"GOTOOLDIR",
+	"GOVERSION",
+}
+
+// goEnvFileName returns the location of the file written by 'go env -w', or empty string if it is disabled.
+func goEnvFileName() string {
+	if goenv, found := os.LookupEnv("GOENV"); found {
+		if goenv == "off" {
+			return ""
+		}
+		return goenv
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil { // The go command does not use GOENV file if there is no config dir either
+		return ""
+	}
+	return filepath.Join(configDir, "go", "env")
+}
+
+// parseGoEnvFile reads a file in GOENV (or $GOROOT/go.env) format.
+// Missing file is not an error.
+func parseGoEnvFile(fileName string) (map[string]string, error) {
+	out := map[string]string{}
+
+	fh, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return nil, err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, found := strings.Cut(line, "="); found {
+			out[k] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", fileName, err)
+	}
+	return out, nil
+}
+
+// compilerEnvironment returns the values of compilerEnvVars as seen by the go command:
+// non-empty environment variables override settings from GOENV file.
+func compilerEnvironment() (map[string]string, error) {
+	fileEnv := map[string]string{}
+	if goEnvFile := goEnvFileName(); goEnvFile != "" {
+		var err error
+		if fileEnv, err = parseGoEnvFile(goEnvFile); err != nil {
+			return nil, fmt.Errorf("failed to read go env config: %w", err)
+		}
+	}
+
+	out := map[string]string{}
+	for _, env := range compilerEnvVars {
+		val, exists := os.LookupEnv(env)
+		if fileVal, fileExists := fileEnv[env]; val == "" && fileExists {
+			val, exists = fileVal, true
+		}
+		if exists {
+			out[env] = val
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+var goHelpEnvironmentVarRE = regexp.MustCompile(`(?m)^\t([A-Z][A-Z0-9_]*(, [A-Z][A-Z0-9_]*)*)$`)
+
+func TestEnvVarsCoverGoHelpEnvironment(t *testing.T) {
+	help := string(must.OK1(exec.Command("go", "help", "environment").Output()))
+
+	var documented []string
+	for _, m := range goHelpEnvironmentVarRE.FindAllStringSubmatch(help, -1) {
+		documented = append(documented, strings.Split(m[1], ", ")...)
+	}
+	assert.True(t, slices.Contains(documented, "GOOS"), "failed to parse 'go help environment'")
+
+	for _, env := range documented {
+		if !slices.Contains(compilerEnvVars, env) && !slices.Contains(ignoredEnvVars, env) {
+			t.Errorf("%s is described by 'go help environment', but is neither in compilerEnvVars nor in ignoredEnvVars", env)
+		}
+	}
+	for _, env := range compilerEnvVars {
+		if slices.Contains(ignoredEnvVars, env) {
+			t.Errorf("%s is both in compilerEnvVars and ignoredEnvVars", env)
+		}
+	}
+}
+
+func TestCompilerEnvironmentReadsGoEnvFile(t *testing.T) {
+	goEnvFile := filepath.Join(t.TempDir(), "env")
+	must.OK(os.WriteFile(goEnvFile, []byte("CGO_ENABLED=0\nGOAMD64=v3\nGOPROXY=off\n"), 0o644))
+	t.Setenv("GOENV", goEnvFile)
+	t.Setenv("CGO_ENABLED", "")
+	t.Setenv("GOAMD64", "v2")
+
+	env := must.OK1(compilerEnvironment())
+	assert.Equal(t, "0", env["CGO_ENABLED"])
+	assert.Equal(t, "v2", env["GOAMD64"]) // Environment overrides GOENV file
+	_, hasGOPROXY := env["GOPROXY"]
+	assert.False(t, hasGOPROXY)
+
+	t.Setenv("GOENV", "off")
+	env = must.OK1(compilerEnvironment())
+	assert.Equal(t, "", env["CGO_ENABLED"])
+}
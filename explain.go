@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+//
+// 'gr -explain' tells why the package would be rebuilt: it compares the inputs of the caching key with the ones
+// recorded for the most recently used build of the package.
+//
+
+func explainCommand(args []string) int {
+	cli, ok := parseCLI("explain", args, nil)
+	if !ok {
+		return 2
+	}
+
+	cp, exitCode := locatePackage(cli)
+	if exitCode != 0 {
+		return exitCode
+	}
+
+	if _, err := os.Stat(cp.exe); err == nil {
+		fmt.Printf("%s is up to date: build %.12s\n", cli.packagePath, cp.checksum)
+		return 0
+	}
+	if _, err := os.Stat(storeFile(cp.cacheDir, cp.checksum)); err == nil {
+		fmt.Printf("%s is up to date: build %.12s is shared with another location\n", cli.packagePath, cp.checksum)
+		return 0
+	}
+
+	latest, lastUse, err := latestCacheEntry(cp.cacheDir, cp.absPackagePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: failed to read cache: %v\n", err)
+		return 255
+	}
+	if latest == "" {
+		fmt.Printf("%s is not cached: it has not been built yet\n", cli.packagePath)
+		return 0
+	}
+
+	contents, err := os.ReadFile(storeInfoFile(cp.cacheDir, latest))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "gr: failed to read cache: %v\n", err)
+		return 255
+	}
+	var info storeInfo
+	if err == nil {
+		if err := json.Unmarshal(contents, &info); err != nil {
+			fmt.Fprintf(os.Stderr, "gr: failed to read cache: %s: %v\n", storeInfoFile(cp.cacheDir, latest), err)
+			return 255
+		}
+	}
+
+	fmt.Printf("%s is not cached: inputs differ from build %.12s, last used %s\n", cli.packagePath, latest,
+		lastUse.Local().Format("2006-01-02 15:04"))
+	if info.Files == nil {
+		fmt.Println("  (the build has been made by an older version of gr, which did not record its inputs)")
+		return 0
+	}
+	for _, line := range diffKeyInputs(info.keyInputs, cp.inputs) {
+		fmt.Println("  " + line)
+	}
+	return 0
+}
+
+// latestCacheEntry returns the checksum of the most recently used build of a package, or an empty string
+// if there are none
+func latestCacheEntry(userCacheDir, absPackagePath string) (retChecksum string, retLastUse time.Time, _ error) {
+	des, err := os.ReadDir(packageCacheDir(userCacheDir, absPackagePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", time.Time{}, nil
+		}
+		return "", time.Time{}, err
+	}
+
+	for _, de := range des {
+		// Temporary files are entries being added
+		if !de.Type().IsRegular() || strings.HasSuffix(de.Name(), ".tmp") {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", time.Time{}, err
+		}
+		if fi.ModTime().After(retLastUse) {
+			retChecksum, retLastUse = de.Name(), fi.ModTime()
+		}
+	}
+	return retChecksum, retLastUse, nil
+}
+
+// diffKeyInputs describes the differences between the inputs of two builds, one per line
+func diffKeyInputs(before, after keyInputs) []string {
+	var out []string
+
+	if before.MainPackage != after.MainPackage {
+		out = append(out, fmt.Sprintf("changed package: %s -> %s", before.MainPackage, after.MainPackage))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(after.Files)) {
+		beforeDigest, found := before.Files[name]
+		switch {
+		case !found:
+			out = append(out, "added file "+name)
+		case beforeDigest != after.Files[name]:
+			out = append(out, "changed file "+name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(before.Files)) {
+		if _, found := after.Files[name]; !found {
+			out = append(out, "removed file "+name)
+		}
+	}
+
+	if !slices.Equal(before.Flags, after.Flags) {
+		out = append(out, fmt.Sprintf("changed flags: %q -> %q", before.Flags, after.Flags))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(after.Env)) {
+		beforeValue, found := before.Env[name]
+		switch {
+		case !found:
+			out = append(out, fmt.Sprintf("added env %s=%q", name, after.Env[name]))
+		case beforeValue != after.Env[name]:
+			out = append(out, fmt.Sprintf("changed env %s: %q -> %q", name, beforeValue, after.Env[name]))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(before.Env)) {
+		if _, found := after.Env[name]; !found {
+			out = append(out, fmt.Sprintf("removed env %s=%q", name, before.Env[name]))
+		}
+	}
+
+	if before.Toolchain.GoBinary != after.Toolchain.GoBinary {
+		out = append(out, fmt.Sprintf("changed go binary: %s -> %s", before.Toolchain.GoBinary, after.Toolchain.GoBinary))
+	}
+	if before.Toolchain.GoVersion != after.Toolchain.GoVersion {
+		out = append(out, fmt.Sprintf("changed go binary version: %s -> %s", before.Toolchain.GoVersion, after.Toolchain.GoVersion))
+	}
+	if before.Toolchain.Toolchain != after.Toolchain.Toolchain {
+		out = append(out, fmt.Sprintf("changed toolchain: %s -> %s", before.Toolchain.Toolchain, after.Toolchain.Toolchain))
+	}
+
+	out = append(out, diffCgoInfo(before.Cgo, after.Cgo)...)
+
+	if len(out) == 0 {
+		out = append(out, "no differences in the recorded inputs")
+	}
+	return out
+}
+
+func diffCgoInfo(before, after *cgoInfo) []string {
+	switch {
+	case before == nil && after == nil:
+		return nil
+	case before == nil:
+		return []string{"cgo is now in effect"}
+	case after == nil:
+		return []string{"cgo is no longer in effect"}
+	}
+
+	var out []string
+	if before.CC != after.CC {
+		out = append(out, fmt.Sprintf("changed C compiler: %s -> %s", before.CC, after.CC))
+	}
+	if before.CXX != after.CXX {
+		out = append(out, fmt.Sprintf("changed C++ compiler: %s -> %s", before.CXX, after.CXX))
+	}
+	for _, args := range slices.Sorted(maps.Keys(after.PkgConfig)) {
+		beforeOutput, found := before.PkgConfig[args]
+		switch {
+		case !found:
+			out = append(out, "added pkg-config "+args)
+		case beforeOutput != after.PkgConfig[args]:
+			out = append(out, fmt.Sprintf("changed pkg-config %s: %q -> %q", args, beforeOutput, after.PkgConfig[args]))
+		}
+	}
+	for _, args := range slices.Sorted(maps.Keys(before.PkgConfig)) {
+		if _, found := after.PkgConfig[args]; !found {
+			out = append(out, "removed pkg-config "+args)
+		}
+	}
+	return out
+}
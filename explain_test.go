@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestDiffKeyInputs(t *testing.T) {
+	before := keyInputs{
+		MainPackage: "example.com/m:cmd/tool",
+		Files: map[string]string{
+			"example.com/m:go.mod":          "1",
+			"example.com/m:cmd/tool/a.go":   "2",
+			"example.com/m:cmd/tool/old.go": "3",
+		},
+		Flags:     []string{"-race"},
+		Env:       map[string]string{"GOOS": "linux", "GOARCH": "amd64", "CGO_ENABLED": "1"},
+		Toolchain: toolchainInfo{GoBinary: "/usr/bin/go", GoVersion: "go1.23.0", Toolchain: "go1.23.0"},
+	}
+	after := keyInputs{
+		MainPackage: "example.com/m:cmd/tool",
+		Files: map[string]string{
+			"example.com/m:go.mod":          "1",
+			"example.com/m:cmd/tool/a.go":   "4",
+			"example.com/m:cmd/tool/new.go": "5",
+		},
+		Env:       map[string]string{"GOOS": "darwin", "GOARCH": "amd64", "GOFLAGS": "-mod=mod"},
+		Toolchain: toolchainInfo{GoBinary: "/usr/bin/go", GoVersion: "go1.23.0", Toolchain: "go1.24.0"},
+	}
+
+	assert.Equal(t, []string{
+		"changed file example.com/m:cmd/tool/a.go",
+		"added file example.com/m:cmd/tool/new.go",
+		"removed file example.com/m:cmd/tool/old.go",
+		`changed flags: ["-race"] -> []`,
+		`added env GOFLAGS="-mod=mod"`,
+		`changed env GOOS: "linux" -> "darwin"`,
+		`removed env CGO_ENABLED="1"`,
+		"changed toolchain: go1.23.0 -> go1.24.0",
+	}, diffKeyInputs(before, after))
+
+	assert.Equal(t, []string{"no differences in the recorded inputs"}, diffKeyInputs(before, before))
+}
+
+func TestDiffCgoInfo(t *testing.T) {
+	before := &cgoInfo{
+		CC:        compilerInfo{Binary: "/usr/bin/gcc", Version: "gcc (Debian 12.2.0-14) 12.2.0"},
+		PkgConfig: map[string]string{"libfoo": "-lfoo\n1.0\n", "libold": "-lold\n1.0\n"},
+	}
+	after := &cgoInfo{
+		CC:        compilerInfo{Binary: "/usr/bin/clang", Version: "Debian clang version 14.0.6"},
+		CXX:       compilerInfo{Binary: "/usr/bin/clang++", Version: "Debian clang version 14.0.6"},
+		PkgConfig: map[string]string{"libfoo": "-lfoo\n1.1\n", "libnew": "-lnew\n1.0\n"},
+	}
+
+	assert.Equal(t, []string{
+		"changed C compiler: /usr/bin/gcc (gcc (Debian 12.2.0-14) 12.2.0) -> /usr/bin/clang (Debian clang version 14.0.6)",
+		"changed C++ compiler:  -> /usr/bin/clang++ (Debian clang version 14.0.6)",
+		`changed pkg-config libfoo: "-lfoo\n1.0\n" -> "-lfoo\n1.1\n"`,
+		"added pkg-config libnew",
+		"removed pkg-config libold",
+	}, diffCgoInfo(before, after))
+
+	assert.Equal(t, []string{"cgo is now in effect"}, diffCgoInfo(nil, after))
+	assert.Zero(t, diffCgoInfo(before, before))
+}
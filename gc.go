@@ -0,0 +1,454 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//
+// cacheCleanup prunes a package directory only when the package is rebuilt, so entries of deleted checkouts and
+// abandoned tools would stay in the cache forever. To prevent that, the whole cache is collected at most once
+// per gcInterval, after a build (only builds add anything to the cache): builds that have not been used for
+// longer than the maximum age are removed, and then the least recently used ones, until the cache fits into
+// the maximum size.
+//
+// A build is a file in the store and all the links to it from package directories, so it is accounted for
+// and removed as a whole. Links are removed with the package directory lock held, and locked package
+// directories are skipped, so entries that another 'gr' is adding are never touched.
+//
+// Running a cached executable marks it as used by updating its modification time, at most once per
+// markUsedInterval to avoid writing to the disk on every run.
+//
+// File hash indexes and toolchain memos are only there to speed up computing the key, so they are removed
+// once unused for longer than the maximum age, and hash indexes are also removed along with their package
+// directories. Loading a hash index marks it as used, while memos are never updated: an expired memo of a
+// toolchain in use is merely recomputed.
+//
+
+const (
+	gcInterval          = 24 * time.Hour
+	defaultCacheMaxAge  = 30 * 24 * time.Hour
+	defaultCacheMaxSize = 10 << 30
+
+	// Builds used this recently are kept regardless of the limits, as another 'gr' might be about to link them
+	gcMinAge = time.Hour
+
+	markUsedInterval = time.Hour
+)
+
+type gcSettings struct {
+	maxAge  time.Duration // 0 means unlimited
+	maxSize int64         // 0 means unlimited
+}
+
+func gcSettingsFromEnv() (gcSettings, error) {
+	out := gcSettings{
+		maxAge:  defaultCacheMaxAge,
+		maxSize: defaultCacheMaxSize,
+	}
+
+	if v := os.Getenv("GR_CACHE_MAX_AGE"); v != "" {
+		var err error
+		if out.maxAge, err = parseCacheMaxAge(v); err != nil {
+			return gcSettings{}, fmt.Errorf("invalid GR_CACHE_MAX_AGE: %w", err)
+		}
+	}
+	if v := os.Getenv("GR_CACHE_MAX_SIZE"); v != "" {
+		var err error
+		if out.maxSize, err = parseCacheMaxSize(v); err != nil {
+			return gcSettings{}, fmt.Errorf("invalid GR_CACHE_MAX_SIZE: %w", err)
+		}
+	}
+	return out, nil
+}
+
+// parseCacheMaxAge accepts Go durations, a number of days ("30d"), or "off"
+func parseCacheMaxAge(s string) (time.Duration, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.ParseUint(days, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number of days", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%q is negative", s)
+	}
+	return d, nil
+}
+
+// parseCacheMaxSize accepts a number of bytes with an optional K, M, G or T suffix (powers of 1024), or "off"
+func parseCacheMaxSize(s string) (int64, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	num, shift := s, 0
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if n, found := strings.CutSuffix(s, suffix); found {
+			num, shift = n, 10*(i+1)
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return n << shift, nil
+}
+
+func gcStampFile(userCacheDir string) string {
+	return filepath.Join(userCacheDir, "gr", "gc-stamp")
+}
+
+func gcLockFile(userCacheDir string) string {
+	return filepath.Join(userCacheDir, "gr", "gc-lock")
+}
+
+// markUsed updates the modification time of a cache entry. Errors are ignored: a missing entry is noticed
+// when it is run, and a read-only cache is merely collected a bit earlier than necessary.
+func markUsed(fileName string, now time.Time) {
+	fi, err := os.Stat(fileName)
+	if err != nil || now.Sub(fi.ModTime()) < markUsedInterval {
+		return
+	}
+	_ = os.Chtimes(fileName, now, now)
+}
+
+// maybeCollectGarbage collects garbage if it has not been done for gcInterval, and nobody is doing it right now
+func maybeCollectGarbage(userCacheDir string, settings gcSettings, now time.Time) error {
+	if settings.maxAge == 0 && settings.maxSize == 0 {
+		return nil
+	}
+
+	stampFile := gcStampFile(userCacheDir)
+	if fi, err := os.Stat(stampFile); err == nil && now.Sub(fi.ModTime()) < gcInterval {
+		return nil
+	}
+
+	lockFile := gcLockFile(userCacheDir)
+	if err := os.MkdirAll(filepath.Dir(lockFile), 0o755); err != nil {
+		return fmt.Errorf("failed to collect garbage in cache: %w", err)
+	}
+	fh, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to collect garbage in cache: %w", err)
+	}
+	defer fh.Close()
+
+	if err := syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) { // Another 'gr' is collecting garbage
+			return nil
+		}
+		return fmt.Errorf("failed to collect garbage in cache: %w", err)
+	}
+
+	// Another 'gr' might have finished collecting garbage while this one was checking the stamp
+	if fi, err := os.Stat(stampFile); err == nil && now.Sub(fi.ModTime()) < gcInterval {
+		return nil
+	}
+
+	if err := collectGarbage(userCacheDir, settings, now); err != nil {
+		return fmt.Errorf("failed to collect garbage in cache: %w", err)
+	}
+
+	if err := writeFileAtomically(stampFile, nil); err != nil {
+		return fmt.Errorf("failed to collect garbage in cache: %w", err)
+	}
+	if err := os.Chtimes(stampFile, now, now); err != nil {
+		return fmt.Errorf("failed to collect garbage in cache: %w", err)
+	}
+	return nil
+}
+
+type cacheLink struct {
+	fileName   string
+	packageDir string // empty for files in the store
+	mtime      time.Time
+}
+
+type cacheBuild struct {
+	links   []cacheLink
+	size    int64
+	lastUse time.Time
+}
+
+// This function should be called with the garbage collection lock held
+func collectGarbage(userCacheDir string, settings gcSettings, now time.Time) error {
+	//
+	// Like cacheCleanup, this function does not ignore filesystem errors, but tolerates files disappearing.
+	//
+
+	builds := map[uint64]*cacheBuild{}
+	addLink := func(fileName, packageDir string, fi os.FileInfo) {
+		inode := newFileStat(fi).Inode
+		b := builds[inode]
+		if b == nil {
+			b = &cacheBuild{size: fi.Size()}
+			builds[inode] = b
+		}
+		b.links = append(b.links, cacheLink{fileName: fileName, packageDir: packageDir, mtime: fi.ModTime()})
+		if fi.ModTime().After(b.lastUse) {
+			b.lastUse = fi.ModTime()
+		}
+	}
+
+	exeDir := packageCacheDir(userCacheDir, "")
+	var dirs []string
+	err := filepath.WalkDir(exeDir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if de.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		if !de.Type().IsRegular() {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		addLink(path, filepath.Dir(path), fi)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	des, err := os.ReadDir(storeDir(userCacheDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var infoFiles []string
+	for _, de := range des {
+		fileName := filepath.Join(storeDir(userCacheDir), de.Name())
+		if strings.HasSuffix(de.Name(), ".json") {
+			infoFiles = append(infoFiles, fileName)
+			continue
+		}
+
+		fi, err := de.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		if strings.HasSuffix(de.Name(), ".tmp") {
+			// Builds in progress are written to temporary files (and directories, for remote packages), so only
+			// remove the ones left by crashed processes
+			if now.Sub(fi.ModTime()) > gcInterval {
+				if err := os.RemoveAll(fileName); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		addLink(fileName, "", fi)
+	}
+
+	// Pick the builds to remove, least recently used first
+
+	var total int64
+	var sorted []*cacheBuild
+	for _, b := range builds {
+		total += b.size
+		sorted = append(sorted, b)
+	}
+	slices.SortFunc(sorted, func(a, b *cacheBuild) int { return a.lastUse.Compare(b.lastUse) })
+
+	var victims []*cacheBuild
+	for _, b := range sorted {
+		age := now.Sub(b.lastUse)
+		expired := settings.maxAge > 0 && age > settings.maxAge
+		oversized := settings.maxSize > 0 && total > settings.maxSize
+		if age < gcMinAge || !expired && !oversized {
+			break
+		}
+		victims = append(victims, b)
+		total -= b.size
+	}
+
+	locks := map[string]*os.File{} // nil for package directories locked by other processes
+	defer func() {
+		for _, fh := range locks {
+			if fh != nil {
+				fh.Close()
+			}
+		}
+	}()
+	lock := func(dir string) (bool, error) {
+		if fh, found := locks[dir]; found {
+			return fh != nil, nil
+		}
+		fh, err := tryLockPackageCacheDir(dir)
+		if err != nil {
+			return false, err
+		}
+		locks[dir] = fh
+		return fh != nil, nil
+	}
+
+	for _, b := range victims {
+		// Remove the store file last, and only if all links are gone, so that a build is never half-removed
+		slices.SortFunc(b.links, func(a, b cacheLink) int { return strings.Compare(b.packageDir, a.packageDir) })
+
+		kept := false
+		for _, l := range b.links {
+			if l.packageDir != "" {
+				locked, err := lock(l.packageDir)
+				if err != nil {
+					return err
+				}
+				if !locked {
+					kept = true
+					continue
+				}
+			} else if kept {
+				continue
+			}
+
+			// The build might have been used since the cache was scanned
+			fi, err := os.Stat(l.fileName)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			if !fi.ModTime().Equal(l.mtime) {
+				kept = true
+				continue
+			}
+
+			removed, err := removeUnlessHeld(l.fileName)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			if !removed { // Held by a user of 'gr -which'
+				kept = true
+			}
+		}
+	}
+
+	// Information files are written after builds are stored, so ones without builds are left from removed builds
+	for _, infoFile := range infoFiles {
+		_, err := os.Stat(strings.TrimSuffix(infoFile, ".json"))
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(infoFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Remove empty package directories, children first
+	slices.Sort(dirs)
+	for _, dir := range slices.Backward(dirs) {
+		if dir == exeDir {
+			continue
+		}
+		locked, err := lock(dir)
+		if err != nil {
+			return err
+		}
+		if !locked {
+			continue
+		}
+		if err := removeEmptyDir(dir); err != nil {
+			return err
+		}
+	}
+
+	return collectKeyCaches(userCacheDir, settings, now)
+}
+
+// collectKeyCaches removes expired file hash indexes and toolchain memos, and the indexes of packages that
+// are no longer in the cache
+func collectKeyCaches(userCacheDir string, settings gcSettings, now time.Time) error {
+	packageIndexes := map[string]bool{}
+	exeDir := packageCacheDir(userCacheDir, "")
+	err := filepath.WalkDir(exeDir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if de.IsDir() && path != exeDir {
+			packageIndexes[filepath.Base(hashIndexFile(userCacheDir, strings.TrimPrefix(path, exeDir)))] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{hashIndexDir(userCacheDir), toolchainMemoDir(userCacheDir)} {
+		des, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, de := range des {
+			fi, err := de.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+
+			// Indexes are saved before the package is built, so orphaned ones are only removed if not recent
+			age := now.Sub(fi.ModTime())
+			var remove bool
+			switch {
+			case strings.HasSuffix(de.Name(), ".tmp"):
+				remove = age > gcInterval
+			case age < gcMinAge:
+				remove = false
+			case settings.maxAge > 0 && age > settings.maxAge:
+				remove = true
+			default:
+				remove = dir == hashIndexDir(userCacheDir) && !packageIndexes[de.Name()]
+			}
+			if !remove {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, de.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+var gcTestNow = time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// mustAddTestBuild puts a build of the given size to the store and links it into package directories
+func mustAddTestBuild(cacheDir, checksum string, size int, lastUse time.Time, packagePaths ...string) {
+	stored := storeFile(cacheDir, checksum)
+	must.OK(os.MkdirAll(filepath.Dir(stored), 0o755))
+	must.OK(os.WriteFile(stored, make([]byte, size), 0o755))
+	must.OK(os.Chtimes(stored, lastUse, lastUse))
+
+	for _, p := range packagePaths {
+		must.OK(os.MkdirAll(packageCacheDir(cacheDir, p), 0o755))
+		must.OK(os.Link(stored, packageCacheFile(cacheDir, p, checksum)))
+	}
+}
+
+func exists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
+
+func TestCollectGarbageByAge(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "old", 10, gcTestNow.Add(-40*24*time.Hour), "/a", "/b")
+	mustAddTestBuild(cacheDir, "new", 10, gcTestNow.Add(-2*time.Hour), "/b", "/c")
+
+	must.OK(collectGarbage(cacheDir, gcSettings{maxAge: 30 * 24 * time.Hour}, gcTestNow))
+
+	assert.False(t, exists(storeFile(cacheDir, "old")))
+	assert.False(t, exists(packageCacheDir(cacheDir, "/a")))
+	assert.False(t, exists(packageCacheFile(cacheDir, "/b", "old")))
+	assert.True(t, exists(storeFile(cacheDir, "new")))
+	assert.True(t, exists(packageCacheFile(cacheDir, "/b", "new")))
+	assert.True(t, exists(packageCacheFile(cacheDir, "/c", "new")))
+}
+
+func TestCollectGarbageBySize(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "oldest", 100, gcTestNow.Add(-5*time.Hour), "/a")
+	mustAddTestBuild(cacheDir, "older", 100, gcTestNow.Add(-4*time.Hour), "/a", "/b")
+	mustAddTestBuild(cacheDir, "newer", 100, gcTestNow.Add(-3*time.Hour), "/b")
+	mustAddTestBuild(cacheDir, "recent", 100, gcTestNow.Add(-time.Minute), "/c")
+
+	// Hard links are accounted for once. Recently used builds are kept even if they do not fit.
+	must.OK(collectGarbage(cacheDir, gcSettings{maxSize: 150}, gcTestNow))
+
+	assert.False(t, exists(storeFile(cacheDir, "oldest")))
+	assert.False(t, exists(storeFile(cacheDir, "older")))
+	assert.False(t, exists(storeFile(cacheDir, "newer")))
+	assert.False(t, exists(packageCacheDir(cacheDir, "/b")))
+	assert.True(t, exists(packageCacheFile(cacheDir, "/c", "recent")))
+}
+
+func TestCollectGarbageSkipsLockedPackages(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "old", 10, gcTestNow.Add(-40*24*time.Hour), "/a", "/b")
+
+	fh := must.OK1(os.Open(packageCacheDir(cacheDir, "/a")))
+	defer fh.Close()
+	must.OK(syscall.Flock(int(fh.Fd()), syscall.LOCK_EX))
+
+	must.OK(collectGarbage(cacheDir, gcSettings{maxAge: 30 * 24 * time.Hour}, gcTestNow))
+
+	assert.True(t, exists(packageCacheFile(cacheDir, "/a", "old")))
+	assert.False(t, exists(packageCacheFile(cacheDir, "/b", "old")))
+	assert.True(t, exists(storeFile(cacheDir, "old")))
+}
+
+func TestCollectGarbageSkipsHeldBuilds(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "old", 10, gcTestNow.Add(-40*24*time.Hour), "/a", "/b")
+
+	fh := must.OK1(os.Open(packageCacheFile(cacheDir, "/b", "old")))
+	defer fh.Close()
+	must.OK(syscall.Flock(int(fh.Fd()), syscall.LOCK_SH))
+
+	must.OK(collectGarbage(cacheDir, gcSettings{maxAge: 30 * 24 * time.Hour}, gcTestNow))
+
+	assert.True(t, exists(packageCacheFile(cacheDir, "/a", "old")))
+	assert.True(t, exists(packageCacheFile(cacheDir, "/b", "old")))
+	assert.True(t, exists(storeFile(cacheDir, "old")))
+}
+
+func TestCollectGarbageRemovesStaleTemporaryFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	must.OK(os.MkdirAll(storeDir(cacheDir), 0o755))
+	for name, mtime := range map[string]time.Time{
+		"stale.123.tmp":   gcTestNow.Add(-48 * time.Hour),
+		"in-progress.tmp": gcTestNow.Add(-30 * time.Minute),
+	} {
+		must.OK(os.WriteFile(filepath.Join(storeDir(cacheDir), name), nil, 0o644))
+		must.OK(os.Chtimes(filepath.Join(storeDir(cacheDir), name), mtime, mtime))
+	}
+
+	must.OK(collectGarbage(cacheDir, gcSettings{maxSize: 1}, gcTestNow))
+
+	assert.False(t, exists(filepath.Join(storeDir(cacheDir), "stale.123.tmp")))
+	assert.True(t, exists(filepath.Join(storeDir(cacheDir), "in-progress.tmp")))
+}
+
+func TestCollectGarbageRemovesKeyCaches(t *testing.T) {
+	cacheDir := t.TempDir()
+	mustAddTestBuild(cacheDir, "new", 10, gcTestNow.Add(-2*time.Hour), "/a")
+
+	for fileName, mtime := range map[string]time.Time{
+		hashIndexFile(cacheDir, "/a"):                     gcTestNow.Add(-2 * time.Hour),
+		hashIndexFile(cacheDir, "/removed"):               gcTestNow.Add(-2 * time.Hour),
+		hashIndexFile(cacheDir, "/being-built"):           gcTestNow.Add(-time.Minute),
+		toolchainMemoFile(cacheDir, "old"):                gcTestNow.Add(-40 * 24 * time.Hour),
+		toolchainMemoFile(cacheDir, "new"):                gcTestNow.Add(-2 * time.Hour),
+		toolchainMemoFile(cacheDir, "crashed") + ".1.tmp": gcTestNow.Add(-48 * time.Hour),
+	} {
+		must.OK(writeFileAtomically(fileName, nil))
+		must.OK(os.Chtimes(fileName, mtime, mtime))
+	}
+
+	must.OK(collectGarbage(cacheDir, gcSettings{maxAge: 30 * 24 * time.Hour}, gcTestNow))
+
+	assert.True(t, exists(hashIndexFile(cacheDir, "/a")))
+	assert.False(t, exists(hashIndexFile(cacheDir, "/removed")))
+	assert.True(t, exists(hashIndexFile(cacheDir, "/being-built")))
+	assert.False(t, exists(toolchainMemoFile(cacheDir, "old")))
+	assert.True(t, exists(toolchainMemoFile(cacheDir, "new")))
+	assert.False(t, exists(toolchainMemoFile(cacheDir, "crashed")+".1.tmp"))
+}
+
+func TestMaybeCollectGarbageIsRateLimited(t *testing.T) {
+	cacheDir := t.TempDir()
+	settings := gcSettings{maxAge: 30 * 24 * time.Hour}
+
+	must.OK(maybeCollectGarbage(cacheDir, settings, gcTestNow))
+
+	mustAddTestBuild(cacheDir, "old", 10, gcTestNow.Add(-40*24*time.Hour), "/a")
+	must.OK(maybeCollectGarbage(cacheDir, settings, gcTestNow.Add(time.Hour)))
+	assert.True(t, exists(storeFile(cacheDir, "old")))
+
+	must.OK(maybeCollectGarbage(cacheDir, settings, gcTestNow.Add(25*time.Hour)))
+	assert.False(t, exists(storeFile(cacheDir, "old")))
+}
+
+func TestParseCacheLimits(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"off":  0,
+		"30d":  30 * 24 * time.Hour,
+		"36h":  36 * time.Hour,
+		"1h5m": time.Hour + 5*time.Minute,
+	} {
+		assert.Equal(t, expected, must.OK1(parseCacheMaxAge(s)), s)
+	}
+	for _, s := range []string{"", "d", "-1h", "1w", "1.5d"} {
+		_, err := parseCacheMaxAge(s)
+		assert.Error(t, err, s)
+	}
+
+	for s, expected := range map[string]int64{
+		"off":  0,
+		"1000": 1000,
+		"2K":   2 << 10,
+		"10G":  10 << 30,
+		"1T":   1 << 40,
+	} {
+		assert.Equal(t, expected, must.OK1(parseCacheMaxSize(s)), s)
+	}
+	for _, s := range []string{"", "G", "-1", "1.5G", "1P", "9999999999T"} {
+		_, err := parseCacheMaxSize(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"io"
 	"io/fs"
@@ -13,6 +15,8 @@ import (
 
 	"github.com/alecthomas/assert/v2"
 	"github.com/dottedmag/must"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
 )
 
 type sut struct {
@@ -60,7 +64,7 @@ func (sut sut) run(t *testing.T, args []string, env []string) (retStdout string,
 	exe := filepath.Join(sut.dir, "exe")
 
 	runCmd := exec.Command(exe, args...)
-	runCmd.Env = append(os.Environ(), "HOME="+sut.dir) // Make sure every test case gets a separate cache
+	runCmd.Env = append(hermeticEnv(), "HOME="+sut.dir) // Make sure every test case gets a separate cache
 	runCmd.Env = append(runCmd.Env, env...)
 	if testing.CoverMode() != "" {
 		coverageDir := filepath.Join(sut.dir, "coverage")
@@ -103,6 +107,33 @@ func (sut sut) run(t *testing.T, args []string, env []string) (retStdout string,
 	return stdout, stderr, 0, nil
 }
 
+// hermeticEnv returns the environment without the settings affecting builds, so the output of the tests does not
+// depend on the developer's environment. The go command reads these from the GOENV file as well, and the
+// environment has priority over it.
+func hermeticEnv() []string {
+	var out []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if buildEnvVar(name) {
+			continue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// buildEnvVar tells if the variable is a setting of the go command other than locations and network access
+func buildEnvVar(name string) bool {
+	switch name {
+	case "GOROOT", "GOPATH", "GOCACHE", "GOTMPDIR",
+		"GOPROXY", "GOSUMDB", "GOPRIVATE", "GONOPROXY", "GONOSUMDB", "GOINSECURE", "GOAUTH", "GOVCS":
+		return false
+	case "CC", "CXX", "AR", "FC", "GCCGO", "PKG_CONFIG":
+		return true
+	}
+	return strings.HasPrefix(name, "GO") || strings.HasPrefix(name, "CGO_")
+}
+
 var anything = regexp.MustCompile(``)
 
 type cliTestCase struct {
@@ -136,12 +167,49 @@ func TestCLI(t *testing.T) {
 		{args: []string{"./testdata/basic"}, stdout: "Hello world!\n"}, // run twice
 		{args: []string{"./testdata/ext"}, stdout: "Hello world!\n", stderr: "go: downloading github.com/dottedmag/must v1.0.0\n"},
 		{args: []string{"./testdata/exit3"}, exitCode: 3},
+		{args: []string{"./testdata/workspace/app"}, stdout: "Hello world!\n"},
+		{args: []string{"./testdata/constraints"}, stdout: "Hello world!\n"},
+		{args: []string{"-tags", "extra", "./testdata/constraints"}, stdout: "Hello extra world!\n"},
+		{args: []string{"./testdata/constraints"}, env: []string{"GOFLAGS=-tags=extra"}, stdout: "Hello extra world!\n"},
+		{args: []string{"./testdata/constraints"}, env: []string{"GOENV=" + must.OK1(filepath.Abs("testdata/goenv/env"))}, stdout: "Hello extra world!\n"},
+		{args: []string{"./testdata/vendor"}, stdout: "Hello world!\n"},
+		{args: []string{"-mod", "vendor", "./testdata/vendor"}, stdout: "Hello world!\n"},
+		{args: []string{"-mod", "unknown", "./testdata/vendor"}, exitCode: 2, stderr: "gr: invalid value \"unknown\" for flag -mod: must be one of mod, readonly, vendor\n"},
+		{args: []string{"-modfile", "testdata/modfile/tools.mod", "./testdata/modfile"}, stdout: "Hello world!\n"},
+		{args: []string{"./testdata/modfile"}, env: []string{"GOFLAGS=-modfile=tools.mod"}, stdout: "Hello world!\n"},
+		{args: []string{"./testdata/overlay"}, stdout: "Hello world!\n"},
+		{args: []string{"-overlay", "testdata/overlay/overlay.json", "./testdata/overlay"}, stdout: "Hello overlay?\n"},
+		{args: []string{"./testdata/pgo"}, stdout: "Hello world!\n"},
+		{args: []string{"-pgo", "off", "./testdata/pgo"}, stdout: "Hello world!\n"},
+		{args: []string{"-pgo", "testdata/pgo/other.pgo", "./testdata/pgo"}, stdout: "Hello world!\n"},
+		{args: []string{"./testdata/cgo-include/app"}, stdout: "Hello world! The answer is 42.\n"},
+		{args: []string{"./testdata/dotless"}, stdout: "Hello world!\n"},
 
 		// Run even if required module is erroneously marked as indirect
 		{args: []string{"./testdata/wrong-module-indirect"}, stdout: "Hello world!\n", stderr: "go: downloading golang.org/x/crypto v0.27.0\n"},
 
 		// Compilation failures
 		{args: []string{"./testdata/syntax-error"}, exitCode: 255, stderrRx: regexp.MustCompile(`undefined: fmt\.Printz`)},
+
+		// Cache management
+		{args: []string{"-cache"}, exitCode: 2, stderrRx: regexp.MustCompile(`Usage: gr -cache`)},
+		{args: []string{"-cache", "unknown"}, exitCode: 2, stderrRx: regexp.MustCompile(`gr -cache: unknown command "unknown"`)},
+		{args: []string{"-cache", "path"}, stdoutRx: regexp.MustCompile(`/gr\n$`)},
+		{args: []string{"-cache", "path", "-json", "./testdata/basic"}, stdoutRx: regexp.MustCompile(`"path": ".*/gr/exe/.*/testdata/basic"`)},
+
+		// Printing the path instead of running
+		{args: []string{"-which", "./testdata/basic"}, stdoutRx: regexp.MustCompile(`^/.*/gr/exe/.*/testdata/basic/[0-9a-f]{64}\n$`)},
+		{args: []string{"-which", "./testdata/basic", "arg"}, exitCode: 2, stderrRx: regexp.MustCompile(`Usage: gr -which`)},
+		{args: []string{"-which", "./testdata/syntax-error"}, exitCode: 255, stderrRx: regexp.MustCompile(`undefined: fmt\.Printz`)},
+
+		{args: []string{"-explain"}, exitCode: 2, stderrRx: regexp.MustCompile(`Usage: gr -explain`)},
+		{args: []string{"-nope", "./testdata/basic"}, exitCode: 2, stderrRx: regexp.MustCompile(`flag provided but not defined: -nope`)},
+
+		// Listing dependencies
+		{args: []string{"-deps", "./testdata/basic"}, stdoutRx: regexp.MustCompile(`^/.*/testdata/basic/basic\.go\n/.*/testdata/basic/go\.mod\n$`)},
+		{args: []string{"-deps", "-format", "make", "-target", "out", "./testdata/basic"}, stdoutRx: regexp.MustCompile(`^out: \\\n  /.*/testdata/basic/basic\.go \\\n  /.*/testdata/basic/go\.mod\n$`)},
+		{args: []string{"-deps", "-format", "xml", "./testdata/basic"}, exitCode: 2, stderrRx: regexp.MustCompile(`invalid value "xml" for flag -format`)},
+
 		// Weird things
 		{args: []string{"./testdata/basic"}, env: []string{"HOME="}, exitCode: 255, stderrRx: regexp.MustCompile(`gr: can't run:`)},
 	} {
@@ -170,3 +238,263 @@ func TestCLI(t *testing.T) {
 		})
 	}
 }
+
+func TestCLISharesBuildsAcrossCheckouts(t *testing.T) {
+	sut := mustBuildSUT(t)
+	defer sut.done()
+
+	t.Setenv("HOME", sut.dir)
+	t.Setenv("XDG_CACHE_HOME", "")
+	cacheDir := must.OK1(os.UserCacheDir())
+
+	var entries []os.FileInfo
+	for _, checkout := range []string{"one", "two"} {
+		dir := filepath.Join(t.TempDir(), checkout)
+		must.OK(os.CopyFS(dir, os.DirFS("testdata/basic")))
+
+		stdout, stderr, exitCode := must.OK3(sut.run(t, []string{dir}, nil))
+		assert.Equal(t, 0, exitCode)
+		assert.Equal(t, "Hello world!\n", stdout)
+		assert.Equal(t, "", stderr)
+
+		des := must.OK1(os.ReadDir(packageCacheDir(cacheDir, dir)))
+		assert.Equal(t, 1, len(des))
+		entries = append(entries, must.OK1(des[0].Info()))
+	}
+
+	assert.Equal(t, entries[0].Name(), entries[1].Name())
+	assert.True(t, os.SameFile(entries[0], entries[1]))
+	assert.True(t, os.SameFile(entries[0], must.OK1(os.Stat(storeFile(cacheDir, entries[0].Name())))))
+}
+
+func TestCLICache(t *testing.T) {
+	sut := mustBuildSUT(t)
+	defer sut.done()
+
+	t.Setenv("HOME", sut.dir)
+	t.Setenv("XDG_CACHE_HOME", "")
+	cacheDir := must.OK1(os.UserCacheDir())
+	absPackagePath := must.OK1(filepath.Abs("testdata/basic"))
+
+	must.OK3(sut.run(t, []string{"./testdata/basic"}, nil))
+	must.OK3(sut.run(t, []string{"-tags", "extra", "./testdata/basic"}, nil))
+
+	stdout, _, exitCode := must.OK3(sut.run(t, []string{"-cache", "ls", "-json"}, nil))
+	assert.Equal(t, 0, exitCode)
+	var packages []cachePackageInfo
+	must.OK(json.Unmarshal([]byte(stdout), &packages))
+	assert.Equal(t, 1, len(packages))
+	assert.Equal(t, absPackagePath, packages[0].Package)
+	assert.Equal(t, 2, len(packages[0].Entries))
+	assert.Equal(t, []string{"-tags", "extra"}, packages[0].Entries[0].Flags)
+
+	stdout, _, exitCode = must.OK3(sut.run(t, []string{"-cache", "ls"}, nil))
+	assert.Equal(t, 0, exitCode)
+	assert.Contains(t, stdout, absPackagePath)
+	assert.Contains(t, stdout, "-tags extra")
+
+	_, _, exitCode = must.OK3(sut.run(t, []string{"-cache", "rm", "./testdata/basic"}, nil))
+	assert.Equal(t, 0, exitCode)
+
+	stdout, _, exitCode = must.OK3(sut.run(t, []string{"-cache", "ls", "-json"}, nil))
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "[]\n", stdout)
+
+	// Removed builds are rebuilt, not linked from the store
+	for _, e := range packages[0].Entries {
+		assert.False(t, exists(storeFile(cacheDir, e.Checksum)))
+	}
+
+	_, _, exitCode = must.OK3(sut.run(t, []string{"-cache", "clean"}, nil))
+	assert.Equal(t, 0, exitCode)
+	stdout, _, _ = must.OK3(sut.run(t, []string{"-cache", "ls", "-json"}, nil))
+	assert.Equal(t, "[]\n", stdout)
+}
+
+func TestCLIWhich(t *testing.T) {
+	sut := mustBuildSUT(t)
+	defer sut.done()
+
+	for range 2 { // Build, then find in cache
+		stdout, stderr, exitCode := must.OK3(sut.run(t, []string{"-which", "./testdata/exit3"}, nil))
+		assert.Equal(t, 0, exitCode)
+		assert.Equal(t, "", stderr)
+
+		exe := strings.TrimSuffix(stdout, "\n")
+		err := exec.Command(exe).Run()
+		var exitErr *exec.ExitError
+		assert.True(t, errors.As(err, &exitErr))
+		assert.Equal(t, 3, exitErr.ExitCode())
+	}
+}
+
+func TestCLIExplain(t *testing.T) {
+	sut := mustBuildSUT(t)
+	defer sut.done()
+
+	dir := t.TempDir()
+	must.OK(os.CopyFS(dir, os.DirFS("testdata/basic")))
+
+	stdout, _, exitCode := must.OK3(sut.run(t, []string{"-explain", dir}, nil))
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, dir+" is not cached: it has not been built yet\n", stdout)
+
+	must.OK3(sut.run(t, []string{dir}, nil))
+
+	stdout, _, exitCode = must.OK3(sut.run(t, []string{"-explain", dir}, nil))
+	assert.Equal(t, 0, exitCode)
+	assert.True(t, strings.HasPrefix(stdout, dir+" is up to date: build "), stdout)
+
+	must.OK(os.WriteFile(filepath.Join(dir, "extra.go"), []byte("package main\n"), 0o644))
+	stdout, _, exitCode = must.OK3(sut.run(t, []string{"-explain", "-tags", "extra", dir}, nil))
+	assert.Equal(t, 0, exitCode)
+	assert.True(t, strings.HasPrefix(stdout, dir+" is not cached: inputs differ from build "), stdout)
+	assert.Contains(t, stdout, "\n  added file testdata/basic:extra.go\n")
+	assert.Contains(t, stdout, "\n  changed flags: [] -> [\"-tags\" \"extra\"]\n")
+}
+
+func TestCLIHash(t *testing.T) {
+	sut := mustBuildSUT(t)
+	defer sut.done()
+
+	var hashes, portableHashes []string
+	for _, checkout := range []string{"one", "two"} {
+		dir := filepath.Join(t.TempDir(), checkout)
+		must.OK(os.CopyFS(dir, os.DirFS("testdata/basic")))
+
+		stdout, stderr, exitCode := must.OK3(sut.run(t, []string{"-hash", dir}, nil))
+		assert.Equal(t, 0, exitCode)
+		assert.Equal(t, "", stderr)
+		hashes = append(hashes, stdout)
+
+		stdout, _, exitCode = must.OK3(sut.run(t, []string{"-hash", "-portable", dir}, nil))
+		assert.Equal(t, 0, exitCode)
+		portableHashes = append(portableHashes, stdout)
+
+		// The hash is the caching key
+		stdout, _, exitCode = must.OK3(sut.run(t, []string{"-which", dir}, nil))
+		assert.Equal(t, 0, exitCode)
+		assert.Equal(t, "v15:"+filepath.Base(stdout), hashes[len(hashes)-1])
+	}
+
+	assert.True(t, regexp.MustCompile(`^v15:[0-9a-f]{64}\n$`).MatchString(hashes[0]), hashes[0])
+	assert.Equal(t, hashes[0], hashes[1])
+	assert.Equal(t, portableHashes[0], portableHashes[1])
+	assert.NotEqual(t, hashes[0], portableHashes[0])
+}
+
+// mustMakeModuleProxy makes a GOPROXY directory serving versions of the module in dir
+func mustMakeModuleProxy(t *testing.T, dir, modulePath string, versions ...string) string {
+	proxyDir := t.TempDir()
+	versionsDir := filepath.Join(proxyDir, modulePath, "@v")
+	must.OK(os.MkdirAll(versionsDir, 0o755))
+
+	for _, v := range versions {
+		must.OK(os.WriteFile(filepath.Join(versionsDir, v+".info"), []byte(`{"Version":"`+v+`","Time":"2024-10-01T12:00:00Z"}`), 0o644))
+		must.OK(os.WriteFile(filepath.Join(versionsDir, v+".mod"), must.OK1(os.ReadFile(filepath.Join(dir, "go.mod"))), 0o644))
+		var zip bytes.Buffer
+		must.OK(modzip.CreateFromDir(&zip, module.Version{Path: modulePath, Version: v}, dir))
+		must.OK(os.WriteFile(filepath.Join(versionsDir, v+".zip"), zip.Bytes(), 0o644))
+	}
+	must.OK(os.WriteFile(filepath.Join(versionsDir, "list"), []byte(strings.Join(versions, "\n")+"\n"), 0o644))
+	return proxyDir
+}
+
+func TestCLIRemotePackage(t *testing.T) {
+	sut := mustBuildSUT(t)
+	defer sut.done()
+
+	proxyDir := mustMakeModuleProxy(t, "testdata/remote", "example.com/remote", "v1.0.0", "v1.1.0")
+
+	// Count runs of the go command
+	goLog := filepath.Join(t.TempDir(), "go.log")
+	goWrapper := filepath.Join(t.TempDir(), "go")
+	realGo := must.OK1(exec.LookPath("go"))
+	must.OK(os.WriteFile(goWrapper, []byte("#!/bin/sh\necho \"$@\" >> "+goLog+"\nexec "+realGo+" \"$@\"\n"), 0o755))
+	goRuns := func() int {
+		contents, err := os.ReadFile(goLog)
+		if os.IsNotExist(err) {
+			return 0
+		}
+		return strings.Count(string(must.OK1(contents, err)), "\n")
+	}
+
+	env := []string{"GO=" + goWrapper, "GOPROXY=file://" + proxyDir, "GOSUMDB=off", "GOFLAGS=-modcacherw", "GOTOOLCHAIN=local"}
+
+	stdout, stderr, exitCode := must.OK3(sut.run(t, []string{"example.com/remote/cmd/hello@v1.0.0"}, env))
+	assert.Equal(t, 0, exitCode, stderr)
+	assert.Equal(t, "Hello from v1.0.0!\n", stdout)
+
+	// Cache hit on an exact version runs neither go nor network
+	runs := goRuns()
+	stdout, stderr, exitCode = must.OK3(sut.run(t, []string{"example.com/remote/cmd/hello@v1.0.0"},
+		append(env, "GOPROXY=off")))
+	assert.Equal(t, 0, exitCode, stderr)
+	assert.Equal(t, "Hello from v1.0.0!\n", stdout)
+	assert.Equal(t, runs, goRuns())
+
+	stdout, stderr, exitCode = must.OK3(sut.run(t, []string{"example.com/remote/cmd/hello@latest"}, env))
+	assert.Equal(t, 0, exitCode, stderr)
+	assert.Equal(t, "Hello from v1.1.0!\n", stdout)
+
+	// Latest version is resolved, but not built again
+	runs = goRuns()
+	stdout, stderr, exitCode = must.OK3(sut.run(t, []string{"-which", "example.com/remote/cmd/hello@latest"}, env))
+	assert.Equal(t, 0, exitCode, stderr)
+	assert.True(t, strings.Contains(stdout, "/gr/exe/example.com/remote/cmd/hello@v1.1.0/"), stdout)
+	assert.Equal(t, runs+1, goRuns())
+
+	_, stderr, exitCode = must.OK3(sut.run(t, []string{"example.com/remote/cmd/nope@v1.0.0"}, env))
+	assert.Equal(t, 255, exitCode)
+	assert.Contains(t, stderr, "example.com/remote/cmd/nope")
+}
+
+func TestCLITool(t *testing.T) {
+	sut := mustBuildSUT(t)
+	defer sut.done()
+
+	wd := must.OK1(os.Getwd())
+	must.OK(os.Chdir(filepath.Join("testdata", "tools")))
+	defer func() { must.OK(os.Chdir(wd)) }()
+
+	for _, tc := range []cliTestCase{
+		{args: []string{"-tool"}, stdout: "testdata/tools/cmd/greet\n"},
+		{args: []string{"-tool", "greet", "tool", "user"}, stdout: "Hello tool user!\n"},
+		{args: []string{"-tool", "testdata/tools/cmd/greet", "world"}, stdout: "Hello world!\n"},
+		{args: []string{"-tool", "stringer"}, exitCode: 255, stderr: "gr: can't find tool: no tool \"stringer\" in go.mod\n"},
+	} {
+		t.Run(cliTestCaseName(tc), func(t *testing.T) {
+			stdout, stderr, exitCode := must.OK3(sut.run(t, tc.args, tc.env))
+			assert.Equal(t, tc.exitCode, exitCode, stderr)
+			assert.Equal(t, tc.stdout, stdout)
+			assert.Equal(t, tc.stderr, stderr)
+		})
+	}
+}
+
+func TestCLIModuleTool(t *testing.T) {
+	sut := mustBuildSUT(t)
+	defer sut.done()
+
+	proxyDir := mustMakeModuleProxy(t, "testdata/remote", "example.com/remote", "v1.0.0", "v1.1.0")
+	env := []string{"GOPROXY=file://" + proxyDir, "GOSUMDB=off", "GOFLAGS=-modcacherw -mod=mod", "GOTOOLCHAIN=local"}
+
+	moduleDir := t.TempDir()
+	must.OK(os.WriteFile(filepath.Join(moduleDir, "go.mod"), []byte("module example.com/app\n\ngo 1.24\n\nrequire example.com/remote v1.0.0\n\ntool example.com/remote/cmd/hello\n"), 0o644))
+
+	wd := must.OK1(os.Getwd())
+	must.OK(os.Chdir(moduleDir))
+	defer func() { must.OK(os.Chdir(wd)) }()
+
+	// The first build adds the checksums of the module to go.sum, which changes the key
+	for range 2 {
+		stdout, stderr, exitCode := must.OK3(sut.run(t, []string{"-tool", "hello"}, env))
+		assert.Equal(t, 0, exitCode, stderr)
+		assert.Equal(t, "Hello from v1.0.0!\n", stdout)
+	}
+
+	// Cached tool is run without downloading its module
+	stdout, stderr, exitCode := must.OK3(sut.run(t, []string{"-tool", "example.com/remote/cmd/hello"}, append(env, "GOPROXY=off")))
+	assert.Equal(t, 0, exitCode, stderr)
+	assert.Equal(t, "Hello from v1.0.0!\n", stdout)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+//
+// 'gr -hash' prints the caching key of a package, for external caches of the outputs of the program. The key is
+// prefixed by the version of the key scheme, so a change of the scheme is visible.
+//
+// Files are named relative to their modules, so the key does not depend on the location of the checkout.
+// Remote packages given as path@version are hashed the same way they are cached.
+// With -portable, the locations of the toolchain and of GOPATH are excluded too, so that the key is the same
+// on machines that have the same version of Go installed in different places.
+//
+
+func hashCommand(args []string) int {
+	var portable bool
+	cli, ok := parseCLI("hash", args, func(flags *flag.FlagSet) {
+		flags.BoolVar(&portable, "portable", false, "exclude the locations of the toolchain and GOPATH from the key")
+	})
+	if !ok {
+		return 2
+	}
+
+	cp, exitCode := locatePackage(cli)
+	if exitCode != 0 {
+		return exitCode
+	}
+
+	inputs := cp.inputs
+	if portable {
+		var err error
+		if inputs, err = trimKeyInputs(inputs); err != nil {
+			fmt.Fprintf(os.Stderr, "gr: can't calculate checksum for package %q with -portable: %v\n", cli.packagePath, err)
+			return 255
+		}
+	}
+
+	fmt.Println(formatKey(inputs.checksum()))
+	return 0
+}
+
+func formatKey(checksum string) string {
+	return fmt.Sprintf("v%d:%s", keyVersion, checksum)
+}
+
+// trimKeyInputs removes the inputs that depend on the location of the toolchain, and fails if the key depends
+// on the location of the source code
+func trimKeyInputs(inputs keyInputs) (keyInputs, error) {
+	if filepath.IsAbs(inputs.MainPackage) {
+		return keyInputs{}, fmt.Errorf("package %s is outside of every module", inputs.MainPackage)
+	}
+	for name := range inputs.Files {
+		if filepath.IsAbs(name) {
+			return keyInputs{}, fmt.Errorf("file %s is outside of every module", name)
+		}
+	}
+
+	env := map[string]string{}
+	for k, v := range inputs.Env {
+		if k != "GOROOT" && k != "GOPATH" {
+			env[k] = v
+		}
+	}
+	inputs.Env = env
+	inputs.Toolchain.GoBinary = ""
+	if inputs.Cgo != nil {
+		cgo := *inputs.Cgo
+		cgo.CC.Binary, cgo.CXX.Binary = "", ""
+		inputs.Cgo = &cgo
+	}
+	return inputs, nil
+}
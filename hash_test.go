@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func TestTrimKeyInputs(t *testing.T) {
+	inputs := keyInputs{
+		MainPackage: "example.com/m:cmd/tool",
+		Files:       map[string]string{"example.com/m:cmd/tool/main.go": "1"},
+		Env:         map[string]string{"GOOS": "linux", "GOROOT": "/opt/go", "GOPATH": "/home/user/go"},
+		Toolchain:   toolchainInfo{GoBinary: "/opt/go/bin/go", GoVersion: "go1.23.0", Toolchain: "go1.23.0"},
+	}
+
+	assert.Equal(t, keyInputs{
+		MainPackage: "example.com/m:cmd/tool",
+		Files:       map[string]string{"example.com/m:cmd/tool/main.go": "1"},
+		Env:         map[string]string{"GOOS": "linux"},
+		Toolchain:   toolchainInfo{GoVersion: "go1.23.0", Toolchain: "go1.23.0"},
+	}, must.OK1(trimKeyInputs(inputs)))
+	assert.Equal(t, "/opt/go/bin/go", inputs.Toolchain.GoBinary)
+
+	inputs.Cgo = &cgoInfo{CC: compilerInfo{Binary: "/usr/bin/gcc", Version: "gcc 12.2.0"}}
+	assert.Equal(t, &cgoInfo{CC: compilerInfo{Version: "gcc 12.2.0"}}, must.OK1(trimKeyInputs(inputs)).Cgo)
+	assert.Equal(t, "/usr/bin/gcc", inputs.Cgo.CC.Binary)
+
+	inputs.Files["/outside/of/module.go"] = "2"
+	_, err := trimKeyInputs(inputs)
+	assert.EqualError(t, err, "file /outside/of/module.go is outside of every module")
+}
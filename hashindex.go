@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//
+// Hashing large files (e.g. embedded assets) on every run is slow, so the digests are stored in an index
+// and reused as long as the file metadata has not changed.
+//
+// There is an index for every package that is run. It is read at the start and atomically replaced at the end,
+// so concurrently running 'gr' processes may only lose each other's updates, which is harmless. The new index
+// contains only files that were consulted during this run, so files that are no longer used get dropped.
+//
+// Filesystem timestamps have limited granularity, so a file modified shortly after it was hashed might keep
+// the same metadata. Such "racy" files are not stored in the index and are hashed again on the next run.
+//
+
+const racyTimestampWindow = time.Second
+
+type hashIndexEntry struct {
+	Stat   fileStat `json:"stat"`
+	Digest string   `json:"sha256"`
+}
+
+type hashIndex struct {
+	fileName string
+	start    time.Time
+
+	mu     sync.Mutex // protects used
+	stored map[string]hashIndexEntry
+	used   map[string]hashIndexEntry
+}
+
+func hashIndexDir(userCacheDir string) string {
+	return filepath.Join(userCacheDir, "gr", "hashes")
+}
+
+func hashIndexFile(userCacheDir, absPackagePath string) string {
+	h := sha256.Sum256([]byte(absPackagePath))
+	return filepath.Join(hashIndexDir(userCacheDir), hex.EncodeToString(h[:]))
+}
+
+func loadHashIndex(userCacheDir, absPackagePath string) (*hashIndex, error) {
+	hi := &hashIndex{
+		fileName: hashIndexFile(userCacheDir, absPackagePath),
+		start:    time.Now(),
+		stored:   map[string]hashIndexEntry{},
+		used:     map[string]hashIndexEntry{},
+	}
+
+	contents, err := os.ReadFile(hi.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hi, nil
+		}
+		return nil, fmt.Errorf("failed to read file hash index: %w", err)
+	}
+
+	// Damaged index is not a problem, it is going to be overwritten
+	if err := json.Unmarshal(contents, &hi.stored); err != nil {
+		hi.stored = map[string]hashIndexEntry{}
+	}
+	// An index is not rewritten if nothing has changed, so it has to be marked as used for garbage collection
+	markUsed(hi.fileName, hi.start)
+	return hi, nil
+}
+
+func (hi *hashIndex) save() error {
+	if maps.Equal(hi.stored, hi.used) {
+		return nil
+	}
+
+	contents, err := json.Marshal(hi.used)
+	if err != nil {
+		panic(fmt.Errorf("internal error: file hash index is not marshalable: %w", err))
+	}
+	if err := writeFileAtomically(hi.fileName, contents); err != nil {
+		return fmt.Errorf("failed to write file hash index: %w", err)
+	}
+	return nil
+}
+
+func (hi *hashIndex) racy(st fileStat) bool {
+	threshold := hi.start.Add(-racyTimestampWindow).UnixNano()
+	return st.Mtime >= threshold || st.Ctime >= threshold
+}
+
+// fileDigest returns SHA-256 digest of a file, reusing the stored one if possible.
+// A nil index hashes every file.
+func (hi *hashIndex) fileDigest(filename string) (string, error) {
+	if hi == nil {
+		return hashFile(filename)
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	st := newFileStat(fi)
+
+	if e, found := hi.stored[filename]; found && e.Stat == st {
+		hi.mu.Lock()
+		hi.used[filename] = e
+		hi.mu.Unlock()
+		return e.Digest, nil
+	}
+
+	digest, err := hashFile(filename)
+	if err != nil {
+		return "", err
+	}
+	if !hi.racy(st) {
+		hi.mu.Lock()
+		hi.used[filename] = hashIndexEntry{Stat: st, Digest: digest}
+		hi.mu.Unlock()
+	}
+	return digest, nil
+}
+
+func hashFile(filename string) (string, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+// Pretend the index is loaded long after the files were modified, so that they are not racy
+func mustLoadHashIndexLater(cacheDir string) *hashIndex {
+	hi := must.OK1(loadHashIndex(cacheDir, "/pkg"))
+	hi.start = hi.start.Add(time.Minute)
+	return hi
+}
+
+func TestHashIndexReusesDigests(t *testing.T) {
+	cacheDir := t.TempDir()
+	fileName := filepath.Join(t.TempDir(), "file")
+	must.OK(os.WriteFile(fileName, []byte("hello"), 0o644))
+
+	hi := mustLoadHashIndexLater(cacheDir)
+	assert.Equal(t, helloSHA256, must.OK1(hi.fileDigest(fileName)))
+	must.OK(hi.save())
+
+	// Tamper with the index to make sure the stored digest is used
+	indexFileName := hashIndexFile(cacheDir, "/pkg")
+	var stored map[string]hashIndexEntry
+	must.OK(json.Unmarshal(must.OK1(os.ReadFile(indexFileName)), &stored))
+	entry := stored[fileName]
+	entry.Digest = "stored"
+	stored[fileName] = entry
+	must.OK(os.WriteFile(indexFileName, must.OK1(json.Marshal(stored)), 0o644))
+
+	hi = mustLoadHashIndexLater(cacheDir)
+	assert.Equal(t, "stored", must.OK1(hi.fileDigest(fileName)))
+
+	// Changed file is hashed again
+	must.OK(os.WriteFile(fileName, []byte("hello, world"), 0o644))
+	hi = mustLoadHashIndexLater(cacheDir)
+	assert.NotEqual(t, "stored", must.OK1(hi.fileDigest(fileName)))
+}
+
+func TestHashIndexSkipsRacyFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	fileName := filepath.Join(t.TempDir(), "file")
+	must.OK(os.WriteFile(fileName, []byte("hello"), 0o644))
+
+	hi := must.OK1(loadHashIndex(cacheDir, "/pkg"))
+	assert.Equal(t, helloSHA256, must.OK1(hi.fileDigest(fileName)))
+	must.OK(hi.save())
+
+	// Nothing to store
+	_, err := os.Stat(hashIndexFile(cacheDir, "/pkg"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHashIndexDropsUnusedFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	dir := t.TempDir()
+	must.OK(os.WriteFile(filepath.Join(dir, "a"), []byte("hello"), 0o644))
+	must.OK(os.WriteFile(filepath.Join(dir, "b"), []byte("hello"), 0o644))
+
+	hi := mustLoadHashIndexLater(cacheDir)
+	must.OK1(hi.fileDigest(filepath.Join(dir, "a")))
+	must.OK1(hi.fileDigest(filepath.Join(dir, "b")))
+	must.OK(hi.save())
+
+	hi = mustLoadHashIndexLater(cacheDir)
+	must.OK1(hi.fileDigest(filepath.Join(dir, "a")))
+	must.OK(hi.save())
+
+	hi = mustLoadHashIndexLater(cacheDir)
+	assert.Equal(t, []string{filepath.Join(dir, "a")}, slices.Collect(maps.Keys(hi.stored)))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dottedmag/must"
+)
+
+func TestReadGoInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		src           string
+		imports       []string
+		embedPatterns []string
+		err           error
+	}{
+		{name: "no imports", src: "package main\n\nfunc main() {}\n"},
+		{name: "single import", src: "package main\nimport \"fmt\"\n", imports: []string{"fmt"}},
+		{
+			name:    "named, dot and blank imports",
+			src:     "package main\nimport (\n\tf \"fmt\"\n\t. \"os\"\n\t_ \"embed\"\n)\n",
+			imports: []string{"fmt", "os", "embed"},
+		},
+		{
+			name:    "several import declarations",
+			src:     "package main; import \"a\"; import (\"b\"; \"c\")\nvar x = 1\nimport \"d\"\n",
+			imports: []string{"a", "b", "c"},
+		},
+		{name: "raw string import", src: "package main\nimport `fmt`\n", imports: []string{"fmt"}},
+		{name: "escaped import", src: "package main\nimport \"\\x66mt\"\n", imports: []string{"fmt"}},
+		{
+			name:    "comments between imports",
+			src:     "// Doc\npackage /* x */ main // y\n\nimport (\n\t// import \"no\"\n\t\"a\" /* \"no\" */\n\t\"b\"\n)\n",
+			imports: []string{"a", "b"},
+		},
+		{name: "byte order mark", src: "\xef\xbb\xbfpackage main\nimport \"fmt\"\n", imports: []string{"fmt"}},
+		{name: "identifier starting with import", src: "package main\nimportant := 1\n", err: errSyntax},
+		{name: "missing package clause", src: "import \"fmt\"\n", err: errSyntax},
+		{name: "unterminated import", src: "package main\nimport \"fmt\n\"\n", err: errSyntax},
+		{name: "unterminated comment", src: "package main\n/* import \"fmt\"\n", err: errSyntax},
+		{name: "NUL byte", src: "package main\nimport \"fmt\x00\"\n", err: errNUL},
+		{
+			name:          "embed",
+			src:           "package main\nimport _ \"embed\"\n\n//go:embed a.txt b/*.txt\n//go:embed \"c d.txt\" `e.txt`\n//go:embed\tf.txt\nvar x string\n",
+			imports:       []string{"embed"},
+			embedPatterns: []string{"a.txt", "b/*.txt", "c d.txt", "e.txt", "f.txt"},
+		},
+		{
+			name:    "embed without importing embed",
+			src:     "package main\n\n//go:embed a.txt\nvar x string\n",
+			imports: nil,
+		},
+		{
+			name:          "embed lookalikes",
+			src:           "package main\nimport \"embed\"\n\n//go:embedded a.txt\n/*\n//go:embed b.txt\n*/\nvar s = `\n//go:embed c.txt\n`\n// go:embed d.txt\n\n//go:embed e.txt\nvar f embed.FS\n",
+			imports:       []string{"embed"},
+			embedPatterns: []string{"e.txt"},
+		},
+		{
+			name:          "embed with CRLF line endings",
+			src:           "package main\r\nimport \"embed\"\r\n\r\n//go:embed a.txt\r\nvar f embed.FS\r\n",
+			imports:       []string{"embed"},
+			embedPatterns: []string{"a.txt"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := readGoInfo(strings.NewReader(tc.src))
+			if err != tc.err {
+				t.Fatalf("Expected error %v, got %v", tc.err, err)
+			}
+			if !slices.Equal(tc.imports, info.imports) {
+				t.Errorf("Expected imports %q, got %q", tc.imports, info.imports)
+			}
+			if !slices.Equal(tc.embedPatterns, info.embedPatterns) {
+				t.Errorf("Expected //go:embed patterns %q, got %q", tc.embedPatterns, info.embedPatterns)
+			}
+		})
+	}
+}
+
+func TestReadGoInfoInvalidEmbed(t *testing.T) {
+	_, err := readGoInfo(strings.NewReader("package main\nimport \"embed\"\n\n//go:embed \"a.txt\nvar f embed.FS\n"))
+	if err == nil || !strings.Contains(err.Error(), "//go:embed") {
+		t.Errorf("Expected //go:embed parse error, got %v", err)
+	}
+}
+
+// TestReadGoInfoMatchesGoParser compares the results of readGoInfo with go/parser on the standard library
+// and this repository.
+func TestReadGoInfoMatchesGoParser(t *testing.T) {
+	goroot := strings.TrimSpace(string(must.OK1(exec.Command(goBinary(), "env", "GOROOT").Output())))
+
+	// Files are matched for several platforms to evaluate their constraints both ways
+	var contexts []*buildContext
+	for _, platform := range [][2]string{{"linux", "amd64"}, {"windows", "arm64"}, {"js", "wasm"}} {
+		contexts = append(contexts, newBuildContext(nil, map[string]string{"GOOS": platform[0], "GOARCH": platform[1]},
+			toolchainTags{ReleaseTags: releaseTags("go1.23.0")}))
+	}
+
+	compared := 0
+	for _, root := range []string{filepath.Join(goroot, "src"), "."} {
+		must.OK(filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != root && (d.Name() == "testdata" || strings.HasPrefix(d.Name(), ".")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasSuffix(path, ".go") {
+				return nil
+			}
+
+			contents := must.OK1(os.ReadFile(path))
+			node, err := parser.ParseFile(token.NewFileSet(), path, contents, parser.SkipObjectResolution|parser.ParseComments)
+			if err != nil {
+				return nil // Some files in GOROOT are intentionally broken
+			}
+			compared++
+
+			var expectedImports, expectedEmbedPatterns []string
+			for _, imp := range node.Imports {
+				expectedImports = append(expectedImports, must.OK1(strconv.Unquote(imp.Path.Value)))
+			}
+			if slices.Contains(expectedImports, "embed") {
+				for _, commentGroup := range node.Comments {
+					for _, comment := range commentGroup.List {
+						name, args, _ := strings.Cut(strings.Replace(comment.Text, "\t", " ", 1), " ")
+						if name == "//go:embed" {
+							expectedEmbedPatterns = append(expectedEmbedPatterns, must.OK1(parseGoEmbed(args))...)
+						}
+					}
+				}
+			}
+
+			info, err := readGoInfo(bytes.NewReader(contents))
+			if err != nil {
+				t.Errorf("%s: %v", path, err)
+				return nil
+			}
+			if !slices.Equal(expectedImports, info.imports) {
+				t.Errorf("%s: expected imports %q, got %q", path, expectedImports, info.imports)
+			}
+			if !slices.Equal(expectedEmbedPatterns, info.embedPatterns) {
+				t.Errorf("%s: expected //go:embed patterns %q, got %q", path, expectedEmbedPatterns, info.embedPatterns)
+			}
+
+			for _, bc := range contexts {
+				expectedMatch, expectedErr := bc.matchFile(path, contents)
+				match, err := bc.matchFile(path, info.header)
+				if expectedMatch != match || (expectedErr == nil) != (err == nil) {
+					t.Errorf("%s: build constraints in the header differ from the ones in the file", path)
+				}
+			}
+			return nil
+		}))
+	}
+
+	if compared < 100 {
+		t.Errorf("Expected to compare at least 100 files, compared %d", compared)
+	}
+}
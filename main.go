@@ -5,52 +5,97 @@ import (
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 func execProgram(path string, argv0 string, args []string) error {
 	return syscall.Exec(path, append([]string{argv0}, args...), os.Environ())
 }
 
-func realMain() int {
-	cli, ok := parseCLI()
-	if !ok {
-		return 2
-	}
+// Subcommands are named like flags, so they never collide with packages: arguments naming packages do not start
+// with '-', and the names of subcommands are not flags of 'go build'.
+var commands = map[string]func(args []string) int{
+	"-cache":   cacheCommand,
+	"-deps":    depsCommand,
+	"-explain": explainCommand,
+	"-hash":    hashCommand,
+	"-tool":    toolCommand,
+	"-which":   whichCommand,
+}
 
+func userCacheDir() (string, error) {
 	cacheDir, err := os.UserCacheDir()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "gr: can't run: %v\n", err)
-		return 255
+		return "", err
 	}
-	cacheDir, err = filepath.Abs(cacheDir)
+	return filepath.Abs(cacheDir)
+}
+
+// cachedPackage is a package and the location of its executable in the cache
+type cachedPackage struct {
+	cacheDir       string
+	absPackagePath string // path@version for remote packages
+	checksum       string
+	inputs         keyInputs
+	exe            string
+	build          buildFunc
+}
+
+// locatePackage finds where the executable of the package is in the cache. Returns non-zero exit code on failure.
+func locatePackage(cli parsedCLI) (cachedPackage, int) {
+	cacheDir, err := userCacheDir()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "gr: can't run: %v\n", err)
-		return 255
+		return cachedPackage{}, 255
 	}
 
-	absPackagePath, err := filepath.Abs(cli.packagePath)
+	if isRemotePackage(cli.packagePath) {
+		inputs, err := remoteInputs(cacheDir, cli.packagePath, cli.compilerFlags, cli.compilerEnv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gr: can't find package %q: %v\n", cli.packagePath, err)
+			return cachedPackage{}, 255
+		}
+		// Remote packages are cached by path and exact version
+		return newCachedPackage(cacheDir, inputs.MainPackage, inputs, func(absOutputPath string) (bool, error) {
+			return buildRemote(inputs.MainPackage, absOutputPath, cli.compilerFlags, cli.compilerEnv)
+		}), 0
+	}
+
+	absPackagePath, err := resolvePackageDir(cli.packagePath, cli.compilerFlags, cli.compilerEnv)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "gr: can't find absolute path for package %q: %v\n", cli.packagePath, err)
-		return 255
+		fmt.Fprintf(os.Stderr, "gr: can't find package %q: %v\n", cli.packagePath, err)
+		return cachedPackage{}, 255
 	}
+	return locateLocalPackage(cacheDir, cli, absPackagePath)
+}
 
-	sum, err := checksum(cli.packagePath, cli.compilerFlags, cli.compilerEnv)
+// locateLocalPackage is locatePackage for a package in a local directory
+func locateLocalPackage(cacheDir string, cli parsedCLI, absPackagePath string) (cachedPackage, int) {
+	inputs, err := checksumInputs(cacheDir, absPackagePath, cli.compilerFlags, cli.compilerEnv)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "gr: internal error: can't calculate checksum for package %q: %v\n", cli.packagePath, err)
-		return 255
+		return cachedPackage{}, 255
 	}
+	return newCachedPackage(cacheDir, absPackagePath, inputs, func(absOutputPath string) (bool, error) {
+		return build(absPackagePath, "", absOutputPath, cli.compilerFlags, cli.compilerEnv), nil
+	}), 0
+}
 
-	p := packageCacheFile(cacheDir, absPackagePath, sum)
-
-	err = execProgram(p, filepath.Base(absPackagePath), cli.runArgs)
-	if !os.IsNotExist(err) {
-		fmt.Fprintf(os.Stderr, "gr: failed to run program: %v\n", err)
-		return 255
+func newCachedPackage(cacheDir, absPackagePath string, inputs keyInputs, build buildFunc) cachedPackage {
+	sum := inputs.checksum()
+	return cachedPackage{
+		cacheDir:       cacheDir,
+		absPackagePath: absPackagePath,
+		checksum:       sum,
+		inputs:         inputs,
+		exe:            packageCacheFile(cacheDir, absPackagePath, sum),
+		build:          build,
 	}
+}
 
-	// The executable didn't exist. Let's build it and try to run again.
-
-	updated, err := updateCache(cacheDir, absPackagePath, sum, cli.compilerFlags, cli.compilerEnv)
+// buildPackage adds the missing executable to the cache. Returns non-zero exit code on failure.
+func buildPackage(cli parsedCLI, cp cachedPackage) int {
+	updated, err := updateCache(cp.cacheDir, cp.absPackagePath, cp.checksum, cp.inputs, cp.build)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "gr: failed to build program: %v\n", err)
 		return 255
@@ -60,7 +105,49 @@ func realMain() int {
 		return 255
 	}
 
-	err = execProgram(p, filepath.Base(absPackagePath), cli.runArgs)
+	if err := maybeCollectGarbage(cp.cacheDir, cli.gc, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "gr: %v\n", err)
+		return 255
+	}
+	return 0
+}
+
+func realMain() int {
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			return command(os.Args[2:])
+		}
+	}
+
+	cli, ok := parseCLI("", os.Args[1:], nil)
+	if !ok {
+		return 2
+	}
+
+	cp, exitCode := locatePackage(cli)
+	if exitCode != 0 {
+		return exitCode
+	}
+
+	return runPackage(cli, cp)
+}
+
+// runPackage runs the executable of the package, building it first if it is not in the cache
+func runPackage(cli parsedCLI, cp cachedPackage) int {
+	markUsed(cp.exe, time.Now())
+	err := execProgram(cp.exe, programName(cp.absPackagePath), cli.runArgs)
+	if !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "gr: failed to run program: %v\n", err)
+		return 255
+	}
+
+	// The executable didn't exist. Let's build it and try to run again.
+
+	if exitCode := buildPackage(cli, cp); exitCode != 0 {
+		return exitCode
+	}
+
+	err = execProgram(cp.exe, programName(cp.absPackagePath), cli.runArgs)
 	fmt.Fprintf(os.Stderr, "gr: failed to run program: %v\n", err)
 	return 255
 }
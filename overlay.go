@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+//
+// -overlay replaces files read by the go command: every file in the overlay is either replaced by another
+// file, or deleted, and files are added to directories the same way. Source code is listed and read through
+// the overlay, so overlaid files are parsed and hashed by their names in the package, and the path of the
+// overlay file itself does not need to be a part of the caching key.
+//
+// Like the go command, relative paths in the overlay are resolved from the directory the build is run in.
+// //go:embed patterns are matched against files on disk, but the files are read through the overlay.
+//
+
+type overlay struct {
+	replace map[string]string   // replacements by absolute paths of overlaid files, empty strings for deleted files
+	dirs    map[string][]string // names of overlaid files by directory
+}
+
+func loadOverlay(fileName string, dir string) (*overlay, error) {
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("reading overlay: %w", err)
+	}
+
+	var raw struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		return nil, fmt.Errorf("parsing overlay JSON: %w", err)
+	}
+
+	out := &overlay{
+		replace: map[string]string{},
+		dirs:    map[string][]string{},
+	}
+	for from, to := range raw.Replace {
+		if from == "" {
+			return nil, fmt.Errorf("empty string key in overlay map")
+		}
+		absFrom := filepath.Clean(absPathFrom(dir, from))
+		if to != "" {
+			to = filepath.Clean(absPathFrom(dir, to))
+		}
+		if _, exists := out.replace[absFrom]; exists {
+			return nil, fmt.Errorf("duplicate paths for %s in overlay map", absFrom)
+		}
+		out.replace[absFrom] = to
+		out.dirs[filepath.Dir(absFrom)] = append(out.dirs[filepath.Dir(absFrom)], filepath.Base(absFrom))
+	}
+	return out, nil
+}
+
+// path returns the name of the file to read instead of fileName. A nil overlay replaces nothing.
+func (o *overlay) path(fileName string) (string, error) {
+	if o == nil {
+		return fileName, nil
+	}
+	to, found := o.replace[fileName]
+	switch {
+	case !found:
+		return fileName, nil
+	case to == "":
+		return "", &fs.PathError{Op: "open", Path: fileName, Err: fs.ErrNotExist}
+	default:
+		return to, nil
+	}
+}
+
+// readDir lists the directory the way the go command sees it: without deleted files and with added ones.
+// Overlaid files are regular files, whatever is on disk in their place.
+func (o *overlay) readDir(dir string) ([]os.DirEntry, error) {
+	des, err := os.ReadDir(dir)
+	if o == nil || len(o.dirs[dir]) == 0 {
+		return des, err
+	}
+	// The directory may only exist in the overlay
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	des = slices.DeleteFunc(des, func(de os.DirEntry) bool {
+		_, found := o.replace[filepath.Join(dir, de.Name())]
+		return found
+	})
+	for _, name := range o.dirs[dir] {
+		if to := o.replace[filepath.Join(dir, name)]; to != "" {
+			des = append(des, overlayDirEntry{name: name, path: to})
+		}
+	}
+	slices.SortFunc(des, func(a, b os.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return des, nil
+}
+
+type overlayDirEntry struct {
+	name string
+	path string // replacement file
+}
+
+func (de overlayDirEntry) Name() string      { return de.name }
+func (de overlayDirEntry) IsDir() bool       { return false }
+func (de overlayDirEntry) Type() fs.FileMode { return 0 }
+
+func (de overlayDirEntry) Info() (fs.FileInfo, error) {
+	fi, err := os.Stat(de.path)
+	if err != nil {
+		return nil, err
+	}
+	return overlayFileInfo{FileInfo: fi, name: de.name}, nil
+}
+
+// overlayFileInfo is the information about the replacement file under the name of the overlaid one
+type overlayFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi overlayFileInfo) Name() string { return fi.name }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	must.OK(os.WriteFile(filepath.Join(dir, "a.go"), nil, 0o644))
+	must.OK(os.WriteFile(filepath.Join(dir, "b.go"), nil, 0o644))
+	must.OK(os.WriteFile(filepath.Join(dir, "overlay.json"), []byte(`{"Replace": {
+		"a.go": "",
+		"c.go": "a.go",
+		"new/d.go": "b.go"
+	}}`), 0o644))
+
+	o := must.OK1(loadOverlay(filepath.Join(dir, "overlay.json"), dir))
+
+	var names []string
+	for _, de := range must.OK1(o.readDir(dir)) {
+		names = append(names, de.Name())
+	}
+	assert.Equal(t, []string{"b.go", "c.go", "overlay.json"}, names)
+
+	// Directories may only exist in the overlay
+	des := must.OK1(o.readDir(filepath.Join(dir, "new")))
+	assert.Equal(t, 1, len(des))
+	assert.Equal(t, "d.go", des[0].Name())
+	assert.Equal(t, "d.go", must.OK1(des[0].Info()).Name())
+
+	assert.Equal(t, filepath.Join(dir, "a.go"), must.OK1(o.path(filepath.Join(dir, "c.go"))))
+	assert.Equal(t, filepath.Join(dir, "b.go"), must.OK1(o.path(filepath.Join(dir, "b.go"))))
+	_, err := o.path(filepath.Join(dir, "a.go"))
+	assert.True(t, os.IsNotExist(err))
+
+	must.OK(os.WriteFile(filepath.Join(dir, "overlay.json"), []byte(`{"Replace": {"": "a.go"}}`), 0o644))
+	_, err = loadOverlay(filepath.Join(dir, "overlay.json"), dir)
+	assert.EqualError(t, err, "empty string key in overlay map")
+}
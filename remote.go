@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	gobuild "go/build"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+//
+// Remote packages are given as 'path@version', the same way as to 'go run' and 'go install', and built in
+// module-aware mode outside of any module by 'go install'.
+//
+// The contents of a module version never change, so the caching key of a remote package does not need its
+// source code: it is the package path and the exact version (which determine the module), the toolchain
+// and build settings. If the version is exact, the key is calculated without running 'go'. Other versions
+// ('latest', branches, prefixes) are resolved to exact ones by 'go list -m', which may access the network;
+// once the version is resolved, a cached build is used without downloading or building anything.
+//
+
+// isRemotePackage tells if the package on the command line is given as path@version
+func isRemotePackage(packagePath string) bool {
+	return !gobuild.IsLocalImport(packagePath) && !filepath.IsAbs(packagePath) && strings.Contains(packagePath, "@")
+}
+
+// splitRemotePackage splits path@version and validates both parts
+func splitRemotePackage(packagePath string) (retPath string, retVersion string, _ error) {
+	p, v, _ := strings.Cut(packagePath, "@")
+	if err := module.CheckImportPath(p); err != nil {
+		return "", "", fmt.Errorf("malformed package %q: %w", packagePath, err)
+	}
+	if v == "" || strings.ContainsAny(v, "@/") {
+		return "", "", fmt.Errorf("malformed package %q: invalid version %q", packagePath, v)
+	}
+	return p, v, nil
+}
+
+// isCachedRemotePackage tells if the path of a package directory in the cache is path@version of a remote
+// package: the version is always exact, and module paths start with a domain name
+func isCachedRemotePackage(p string) bool {
+	packagePath, v, found := strings.Cut(p, "@")
+	return found && module.CheckPath(packagePath) == nil && v != "" && module.CanonicalVersion(v) == v
+}
+
+// remoteInputs calculates the inputs of the caching key of a remote package
+func remoteInputs(userCacheDir, packagePath string, compilerFlags []string, compilerEnv map[string]string) (keyInputs, error) {
+	p, v, err := splitRemotePackage(packagePath)
+	if err != nil {
+		return keyInputs{}, err
+	}
+
+	if module.CanonicalVersion(v) != v {
+		if v, err = resolveRemoteVersion(p, v, compilerEnv); err != nil {
+			return keyInputs{}, err
+		}
+	}
+
+	// There is no main module or workspace to require a toolchain
+	toolchain, err := resolveToolchainFor(userCacheDir, "", "", compilerEnv)
+	if err != nil {
+		return keyInputs{}, err
+	}
+
+	return keyInputs{
+		MainPackage: p + "@" + v,
+		Files:       map[string]string{},
+		Flags:       compilerFlags,
+		Env:         compilerEnv,
+		Toolchain:   toolchain,
+	}, nil
+}
+
+// resolveRemoteVersion resolves a version query to the exact version of the module providing the package.
+//
+// Like the go command, it looks the query up for every prefix of the package path, and picks the longest
+// one that is a module.
+func resolveRemoteVersion(packagePath, query string, compilerEnv map[string]string) (string, error) {
+	listCmd := exec.Command(goBinary(), "list", "-m", "-e", "-json")
+	for p := packagePath; p != "."; p = path.Dir(p) {
+		listCmd.Args = append(listCmd.Args, p+"@"+query)
+	}
+	listCmd.Env = remoteEnv(compilerEnv)
+	listCmd.Dir = "/"
+	listCmd.Stderr = os.Stderr
+	out, err := listCmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve version of %s@%s: %w", packagePath, query, err)
+	}
+
+	var errs []error
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var m struct {
+			Path    string
+			Version string
+			Error   *struct{ Err string }
+		}
+		if err := dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", fmt.Errorf("failed to resolve version of %s@%s: %w", packagePath, query, err)
+		}
+		// Modules are listed in the order of arguments, longest path first
+		if m.Error == nil && m.Version != "" {
+			return m.Version, nil
+		}
+		if m.Error != nil {
+			errs = append(errs, errors.New(m.Error.Err))
+		}
+	}
+	return "", fmt.Errorf("failed to resolve version of %s@%s: %w", packagePath, query, errors.Join(errs...))
+}
+
+// remoteEnv is the environment of the go command run for remote packages: outside of any module or workspace
+func remoteEnv(compilerEnv map[string]string) []string {
+	env := os.Environ()
+	for k, v := range compilerEnv {
+		env = append(env, k+"="+v)
+	}
+	return append(env, "GOWORK=off")
+}
+
+// buildRemote builds a remote package given as path@version by 'go install' to a temporary GOBIN, and moves
+// the executable to absOutputPath
+func buildRemote(packagePath string, absOutputPath string, compilerFlags []string, compilerEnv map[string]string) (retBuilt bool, _ error) {
+	binDir, err := os.MkdirTemp(filepath.Dir(absOutputPath), filepath.Base(absOutputPath)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(binDir)
+
+	installCmd := exec.Command(goBinary(), "install", "-trimpath")
+	installCmd.Args = append(installCmd.Args, compilerFlags...)
+	installCmd.Args = append(installCmd.Args, packagePath)
+	installCmd.Env = append(remoteEnv(compilerEnv), "GOBIN="+binDir)
+	installCmd.Dir = "/"
+	installCmd.Stdout = os.Stdout
+	installCmd.Stderr = os.Stderr
+	if installCmd.Run() != nil {
+		return false, nil
+	}
+
+	des, err := os.ReadDir(binDir)
+	if err != nil {
+		return false, err
+	}
+	if len(des) != 1 {
+		return false, fmt.Errorf("expected 'go install %s' to install one executable, got %d files", packagePath, len(des))
+	}
+	return true, os.Rename(filepath.Join(binDir, des[0].Name()), absOutputPath)
+}
+
+// programName is the name of the executable of a package: the name of its directory, or, for remote packages
+// and tools, the name 'go install' gives it
+func programName(absPackagePath string) string {
+	if isRemotePackage(absPackagePath) {
+		p, _, _ := strings.Cut(absPackagePath, "@")
+		return executableName(p)
+	}
+	if _, toolPath, found := strings.Cut(filepath.ToSlash(absPackagePath), "/@tool/"); found {
+		return executableName(toolPath)
+	}
+	return filepath.Base(absPackagePath)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestRemotePackageNames(t *testing.T) {
+	for p, expected := range map[string]bool{
+		"golang.org/x/tools/cmd/stringer@v0.25.0": true,
+		"golang.org/x/tools/cmd/stringer@latest":  true,
+		"example.com/tool":                        false,
+		"./tool@v1.0.0":                           false,
+		"/home/user/tool@v1.0.0":                  false,
+	} {
+		assert.Equal(t, expected, isRemotePackage(p), p)
+	}
+
+	for p, expected := range map[string]bool{
+		"golang.org/x/tools/cmd/stringer@v0.25.0": true,
+		"golang.org/x/tools/cmd/stringer@latest":  false,
+		"home/user/tool@v1.0.0":                   false,
+		"example.com/tool":                        false,
+		"example.com/tool@":                       false,
+	} {
+		assert.Equal(t, expected, isCachedRemotePackage(p), p)
+	}
+
+	for p, expected := range map[string]string{
+		"/home/user/tool":                          "tool",
+		"golang.org/x/tools/cmd/stringer@v0.25.0":  "stringer",
+		"example.com/tool/v2@v2.1.0":               "tool",
+		"/home/user/app/@tool/example.com/tool/v2": "tool",
+	} {
+		assert.Equal(t, expected, programName(p), p)
+	}
+}
+
+func TestSplitRemotePackage(t *testing.T) {
+	p, v, err := splitRemotePackage("golang.org/x/tools/cmd/stringer@latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "golang.org/x/tools/cmd/stringer", p)
+	assert.Equal(t, "latest", v)
+
+	for _, invalid := range []string{"example.com/tool@", "example.com/tool@v1@v2", "example.com//tool@v1.0.0"} {
+		_, _, err := splitRemotePackage(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileStat is the metadata that changes whenever a file is modified or replaced.
+type fileStat struct {
+	Size  int64
+	Mtime int64 // nanoseconds
+	Ctime int64 // nanoseconds
+	Inode uint64
+}
+
+func newFileStat(fi os.FileInfo) fileStat {
+	out := fileStat{
+		Size:  fi.Size(),
+		Mtime: fi.ModTime().UnixNano(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		ctim := ctime(st)
+		out.Ctime = ctim.Nano()
+		out.Inode = st.Ino
+	}
+	return out
+}
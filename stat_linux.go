@@ -0,0 +1,7 @@
+package main
+
+import "syscall"
+
+func ctime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Ctim
+}
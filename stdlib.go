@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+//
+// Imports of the standard library are not followed, as the toolchain is a part of the key. The go command
+// considers an import path to be in the standard library if its first element has no dot and the directory
+// of the package in $GOROOT/src contains .go files. Any other path, dotless or not, is resolved through go.mod,
+// so modules may have names like 'mycorp/tools'.
+//
+// The packages are listed from GOROOT of the selected toolchain. Listing GOROOT is relatively slow, so the list is
+// memoized on disk: by GOROOT and the version of the local toolchain, or by the name of another toolchain, which
+// is asked for its GOROOT (downloading it, the same way the build would). If it can't be downloaded, the build
+// fails anyway, so the packages of the local toolchain are good enough, and dotless paths not provided by any
+// module are left to the go command.
+//
+
+// stdImportPath tells if the import path may belong to the standard library: its first element has no dot
+func stdImportPath(importPath string) bool {
+	elem, _, _ := strings.Cut(importPath, "/")
+	return !strings.Contains(elem, ".")
+}
+
+// loadStdlib returns the import paths of the standard library packages of the selected toolchain
+func loadStdlib(userCacheDir string, toolchain toolchainInfo) (map[string]bool, error) {
+	_, local, err := lookupLocalToolchain(userCacheDir)
+	if err != nil {
+		return nil, err
+	}
+	localGoroot := func() (string, error) { return local.GOROOT, nil }
+	localMemoFile := toolchainMemoFile(userCacheDir, "stdlib", local.GOROOT, local.GoVersion)
+
+	var packages []string
+	if toolchain.Toolchain == toolchain.GoVersion {
+		if packages, err = memoizedStdlib(localMemoFile, localGoroot); err != nil {
+			return nil, err
+		}
+	} else {
+		memoFile := toolchainMemoFile(userCacheDir, "stdlib", toolchain.Toolchain)
+		packages, err = memoizedStdlib(memoFile, func() (string, error) { return lookupGoroot(toolchain) })
+		if err != nil {
+			if packages, err = memoizedStdlib(localMemoFile, localGoroot); err != nil {
+				return nil, err
+			}
+			if err := writeStdlib(memoFile, packages); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	out := make(map[string]bool, len(packages))
+	for _, p := range packages {
+		out[p] = true
+	}
+	return out, nil
+}
+
+func memoizedStdlib(memoFile string, goroot func() (string, error)) ([]string, error) {
+	var packages []string
+	if contents, err := os.ReadFile(memoFile); err == nil && json.Unmarshal(contents, &packages) == nil {
+		return packages, nil
+	}
+
+	dir, err := goroot()
+	if err != nil {
+		return nil, err
+	}
+	if packages, err = listStdlib(dir); err != nil {
+		return nil, fmt.Errorf("failed to list standard library: %w", err)
+	}
+	if err := writeStdlib(memoFile, packages); err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+func writeStdlib(memoFile string, packages []string) error {
+	contents, err := json.Marshal(packages)
+	if err != nil {
+		panic(fmt.Errorf("internal error: standard library is not marshalable: %w", err))
+	}
+	if err := writeFileAtomically(memoFile, contents); err != nil {
+		return fmt.Errorf("failed to memoize standard library: %w", err)
+	}
+	return nil
+}
+
+// lookupGoroot asks the go command for GOROOT of another toolchain
+func lookupGoroot(toolchain toolchainInfo) (string, error) {
+	envCmd := exec.Command(toolchain.GoBinary, "env", "GOROOT")
+	envCmd.Env = append(os.Environ(), "GOTOOLCHAIN="+toolchain.Toolchain, "GOENV=off", "GOFLAGS=")
+	envCmd.Dir = "/"
+	out, err := envCmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to query %s for GOROOT: %w", toolchain.Toolchain, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// listStdlib lists the directories of $GOROOT/src containing .go files, skipping the ones that can't be imported
+func listStdlib(goroot string) ([]string, error) {
+	srcDir := filepath.Join(goroot, "src")
+
+	var out []string
+	err := filepath.WalkDir(srcDir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() {
+			name := de.Name()
+			if path != srcDir && (name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(de.Name(), ".go") {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		if dir == srcDir {
+			return nil
+		}
+		importPath := filepath.ToSlash(strings.TrimPrefix(dir, srcDir+string(filepath.Separator)))
+		if len(out) == 0 || out[len(out)-1] != importPath {
+			out = append(out, importPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Files of a directory may be listed before and after its subdirectories
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
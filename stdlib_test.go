@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func TestLoadStdlib(t *testing.T) {
+	cacheDir := t.TempDir()
+	goBin, local := must.OK2(lookupLocalToolchain(cacheDir))
+	toolchain := toolchainInfo{GoBinary: goBin, GoVersion: local.GoVersion, Toolchain: local.GoVersion}
+
+	stdlib := must.OK1(loadStdlib(cacheDir, toolchain))
+	for _, p := range []string{"fmt", "net/http", "internal/abi", "cmd/go", "unsafe"} {
+		assert.True(t, stdlib[p], p)
+	}
+	for _, p := range []string{"", "go", "cmd", "vendor/golang.org/x/net/http2/hpack", "cmd/go/testdata/script", "mycorp/tools"} {
+		assert.False(t, stdlib[p], p)
+	}
+
+	// The second load reads the memo instead of listing GOROOT
+	must.OK(os.WriteFile(toolchainMemoFile(cacheDir, "stdlib", local.GOROOT, local.GoVersion), []byte(`["memoized"]`), 0o644))
+	assert.Equal(t, map[string]bool{"memoized": true}, must.OK1(loadStdlib(cacheDir, toolchain)))
+
+	// Another toolchain has its own standard library
+	toolchain.Toolchain = "go1.999.0"
+	must.OK(writeStdlib(toolchainMemoFile(cacheDir, "stdlib", "go1.999.0"), []string{"fmt", "newstd"}))
+	assert.Equal(t, map[string]bool{"fmt": true, "newstd": true}, must.OK1(loadStdlib(cacheDir, toolchain)))
+}
+
+func TestLoadStdlibFallbackIsMemoized(t *testing.T) {
+	t.Setenv("GOPROXY", "off")
+	cacheDir := t.TempDir()
+	goBin, local := must.OK2(lookupLocalToolchain(cacheDir))
+	toolchain := toolchainInfo{GoBinary: goBin, GoVersion: local.GoVersion, Toolchain: "go1.999.0"}
+
+	// The toolchain can't be downloaded, so the packages of the local one are used, and not asked for again
+	stdlib := must.OK1(loadStdlib(cacheDir, toolchain))
+	assert.True(t, stdlib["fmt"])
+	packages := must.OK1(memoizedStdlib(toolchainMemoFile(cacheDir, "stdlib", "go1.999.0"), func() (string, error) {
+		return "", errors.New("GOROOT is not asked for")
+	}))
+	assert.Equal(t, len(stdlib), len(packages))
+}
+
+func TestStdImportPath(t *testing.T) {
+	assert.True(t, stdImportPath("fmt"))
+	assert.True(t, stdImportPath("mycorp/tools"))
+	assert.False(t, stdImportPath("drozd.in/tools"))
+	assert.False(t, stdImportPath("example.com"))
+}
@@ -0,0 +1,3 @@
+module testdata/asm-include
+
+go 1.23
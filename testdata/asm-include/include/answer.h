@@ -0,0 +1,2 @@
+#define TENS 4
+#define ONES 2
@@ -0,0 +1,9 @@
+package main
+
+import "fmt"
+
+func answer() int
+
+func main() {
+	fmt.Printf("Hello world! The answer is %d.\n", answer())
+}
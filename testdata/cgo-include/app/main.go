@@ -0,0 +1,14 @@
+package main
+
+// #cgo windows CFLAGS: -I${SRCDIR}/../windows
+// #cgo CFLAGS: -I${SRCDIR}/../include
+// #include <stdio.h>
+// #include <greeting.h>
+// #include "../common/twice.h"
+import "C"
+
+import "fmt"
+
+func main() {
+	fmt.Printf("%s The answer is %d.\n", C.GoString(C.greeting()), C.twice(21))
+}
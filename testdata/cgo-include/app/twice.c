@@ -0,0 +1,5 @@
+#include "../common/twice.h"
+
+int twice(int x) {
+	return x * TWICE;
+}
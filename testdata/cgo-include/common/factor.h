@@ -0,0 +1 @@
+#define TWICE 2
@@ -0,0 +1,3 @@
+#include "factor.h"
+
+int twice(int x);
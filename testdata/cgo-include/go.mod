@@ -0,0 +1,3 @@
+module testdata/cgo-include
+
+go 1.23
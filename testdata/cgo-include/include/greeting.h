@@ -0,0 +1,5 @@
+#include "greeting_text.h"
+
+static const char *greeting(void) {
+	return GREETING;
+}
@@ -0,0 +1,3 @@
+static const char *greeting(void) {
+	return "Hello Windows!";
+}
@@ -0,0 +1,3 @@
+module testdata/cgo-toolchain
+
+go 1.23
@@ -0,0 +1,12 @@
+package main
+
+// #cgo pkg-config: --static libfoo
+// #cgo linux pkg-config: libbar
+// int twice(int x);
+import "C"
+
+import "fmt"
+
+func main() {
+	fmt.Println(C.twice(21))
+}
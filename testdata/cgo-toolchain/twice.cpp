@@ -0,0 +1,3 @@
+extern "C" int twice(int x) {
+	return x * 2;
+}
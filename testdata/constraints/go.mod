@@ -0,0 +1,3 @@
+module drozd.in/constraints
+
+go 1.23
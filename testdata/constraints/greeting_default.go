@@ -0,0 +1,7 @@
+//go:build !extra
+
+package main
+
+func greeting() string {
+	return "Hello world!"
+}
@@ -0,0 +1,3 @@
+package main
+
+import _ "drozd.in/windows-only"
@@ -0,0 +1,7 @@
+module mycorp/tools
+
+go 1.23
+
+require internal-lib/x v0.0.0
+
+replace internal-lib/x => ./x
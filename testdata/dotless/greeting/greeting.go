@@ -0,0 +1,5 @@
+package greeting
+
+func Greeting() string {
+	return "Hello world"
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"fmt"
+
+	"internal-lib/x"
+	"mycorp/tools/greeting"
+)
+
+func main() {
+	fmt.Println(greeting.Greeting() + x.Suffix)
+}
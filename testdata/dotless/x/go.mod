@@ -0,0 +1,3 @@
+module internal-lib/x
+
+go 1.23
@@ -0,0 +1,3 @@
+module testdata/modfile
+
+go 1.23
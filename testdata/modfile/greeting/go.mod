@@ -0,0 +1,3 @@
+module drozd.in/greeting
+
+go 1.23
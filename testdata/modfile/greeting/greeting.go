@@ -0,0 +1,3 @@
+package greeting
+
+const Text = "Hello world!"
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+
+	"drozd.in/greeting"
+)
+
+func main() {
+	fmt.Println(greeting.Text)
+}
@@ -0,0 +1,7 @@
+module testdata/modfile
+
+go 1.23
+
+require drozd.in/greeting v0.0.0
+
+replace drozd.in/greeting => ./greeting
@@ -0,0 +1,3 @@
+module testdata/overlay
+
+go 1.23
@@ -0,0 +1,3 @@
+module testdata/pgo
+
+go 1.23
@@ -0,0 +1,3 @@
+module testdata/release-tags
+
+go 1.23
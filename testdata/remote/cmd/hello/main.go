@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+func main() {
+	bi, _ := debug.ReadBuildInfo()
+	fmt.Printf("Hello from %s!\n", bi.Main.Version)
+}
@@ -0,0 +1,9 @@
+module testdata/replaced-tool
+
+go 1.24
+
+tool example.com/greeter/cmd/greet
+
+require example.com/greeter v0.0.0
+
+replace example.com/greeter => ./greeter
@@ -0,0 +1,4 @@
+class Counter {
+public:
+	int next();
+};
@@ -0,0 +1,3 @@
+module testdata/swig
+
+go 1.23
@@ -0,0 +1 @@
+const char *greeting(void);
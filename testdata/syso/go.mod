@@ -0,0 +1,3 @@
+module testdata/syso
+
+go 1.23
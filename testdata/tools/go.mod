@@ -0,0 +1,5 @@
+module testdata/tools
+
+go 1.24
+
+tool testdata/tools/cmd/greet
@@ -0,0 +1,5 @@
+module drozd.in/app
+
+go 1.23
+
+require drozd.in/patched v1.0.0
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"drozd.in/lib"
+	"drozd.in/patched"
+)
+
+func main() {
+	lib.Run()
+	patched.Run()
+}
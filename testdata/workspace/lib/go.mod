@@ -0,0 +1,3 @@
+module drozd.in/lib
+
+go 1.23
@@ -0,0 +1,7 @@
+package lib
+
+import "fmt"
+
+func Run() {
+	fmt.Print("Hello ")
+}
@@ -0,0 +1,3 @@
+module drozd.in/patched
+
+go 1.23
@@ -0,0 +1,7 @@
+package patched
+
+import "fmt"
+
+func Run() {
+	fmt.Println("world!")
+}
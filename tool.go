@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+//
+// 'gr -tool <name>' runs a tool declared by a 'tool' directive in go.mod of the main module (or of any module
+// in the workspace), like 'go tool <name>' does. The name is either the package path of the tool, or the last
+// element of it.
+//
+// Tools are built by package path from the main module, so that they use its build list. If the package of
+// a tool is local, it is cached like any other local package, but parsed with the main module of the build.
+// Otherwise the versions of its source code are
+// determined by go.mod and go.sum files (and workspace files), so the caching key is the package path and
+// these files.
+//
+
+func toolCommand(args []string) int {
+	if len(args) == 0 {
+		return listToolsCommand()
+	}
+
+	cli, ok := parseCLI("tool", args, nil)
+	if !ok {
+		return 2
+	}
+
+	cp, exitCode := locateTool(cli)
+	if exitCode != 0 {
+		return exitCode
+	}
+	return runPackage(cli, cp)
+}
+
+func listToolsCommand() int {
+	compilerEnv, err := compilerEnvironment()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't run: %v\n", err)
+		return 255
+	}
+
+	_, tools, err := findTools(nil, compilerEnv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't list tools: %v\n", err)
+		return 255
+	}
+	for _, t := range tools {
+		fmt.Println(t)
+	}
+	return 0
+}
+
+// findTools returns the tools of the main module or workspace of the current directory, sorted
+func findTools(compilerFlags []string, compilerEnv map[string]string) (*parseContext, []string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pc, err := newMainParseContext(wd, compilerFlags, compilerEnv, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pc.workspace != nil {
+		return pc, pc.workspace.tools, nil
+	}
+	tools := append([]string{}, pc.mainModule.tools...)
+	slices.Sort(tools)
+	return pc, slices.Compact(tools), nil
+}
+
+// matchTool finds the package of a tool by its package path or name
+func matchTool(tools []string, name string) (string, error) {
+	var matches []string
+	for _, t := range tools {
+		if t == name {
+			return t, nil
+		}
+		if executableName(t) == name {
+			matches = append(matches, t)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no tool %q in go.mod", name)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("tool %q is ambiguous, use one of: %s", name, strings.Join(matches, ", "))
+	}
+}
+
+// locateTool is locatePackage for a tool
+func locateTool(cli parsedCLI) (cachedPackage, int) {
+	cacheDir, err := userCacheDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't run: %v\n", err)
+		return cachedPackage{}, 255
+	}
+
+	pc, tools, err := findTools(cli.compilerFlags, cli.compilerEnv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't find tool %q: %v\n", cli.packagePath, err)
+		return cachedPackage{}, 255
+	}
+	toolPath, err := matchTool(tools, cli.packagePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't find tool: %v\n", err)
+		return cachedPackage{}, 255
+	}
+
+	build := func(absOutputPath string) (bool, error) {
+		return build(pc.mainModule.dir, toolPath, absOutputPath, cli.compilerFlags, cli.compilerEnv), nil
+	}
+
+	dir, local, err := resolveImport(pc, pc.mainModule.dir, toolPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: can't find tool %q: %v\n", toolPath, err)
+		return cachedPackage{}, 255
+	}
+	if local {
+		// The tool is built from the main module, which may be another module than the one of the tool
+		inputs, err := checksumInputsFrom(cacheDir, pc.mainModule.dir, dir, cli.compilerFlags, cli.compilerEnv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gr: internal error: can't calculate checksum for tool %q: %v\n", toolPath, err)
+			return cachedPackage{}, 255
+		}
+		return newCachedPackage(cacheDir, dir, inputs, build), 0
+	}
+
+	inputs, err := moduleToolInputs(cacheDir, pc, toolPath, cli.compilerFlags, cli.compilerEnv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gr: internal error: can't calculate checksum for tool %q: %v\n", toolPath, err)
+		return cachedPackage{}, 255
+	}
+	return newCachedPackage(cacheDir, toolCacheDir(pc.mainModule.dir, toolPath), inputs, build), 0
+}
+
+// toolCacheDir is the directory of the tool in the cache, as tools that are not local have no directories
+func toolCacheDir(mainModuleDir, toolPath string) string {
+	return filepath.Join(mainModuleDir, "@tool", filepath.FromSlash(toolPath))
+}
+
+// moduleToolInputs calculates the inputs of the caching key of a tool in a remote module
+func moduleToolInputs(userCacheDir string, pc *parseContext, toolPath string, compilerFlags []string, compilerEnv map[string]string) (keyInputs, error) {
+	toolchain, err := resolveToolchain(userCacheDir, pc, compilerEnv)
+	if err != nil {
+		return keyInputs{}, err
+	}
+
+	// The profile in the package directory is a part of the module, and it is selected by go.sum as well
+	if err := addProfileChecksum(pc, pc.mainModule.dir, "", compilerFlags, compilerEnv); err != nil {
+		return keyInputs{}, err
+	}
+
+	// Only the files that select the versions of modules and the profile have been read
+	files, err := relocatableChecksums(pc)
+	if err != nil {
+		return keyInputs{}, err
+	}
+
+	return keyInputs{
+		MainPackage: toolPath,
+		Files:       files,
+		Flags:       relocatableFlags(pc, compilerFlags),
+		Env:         relocatableEnv(pc, compilerEnv),
+		Toolchain:   toolchain,
+	}, nil
+}
+
+// executableName is the name 'go build' and 'go install' give to the executable of a package: the last element
+// of the package path that is not a major version suffix
+func executableName(packagePath string) string {
+	if prefix, major, ok := module.SplitPathVersion(packagePath); ok && strings.HasPrefix(major, "/v") {
+		return path.Base(prefix)
+	}
+	return path.Base(packagePath)
+}
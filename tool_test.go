@@ -0,0 +1,59 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func TestMatchTool(t *testing.T) {
+	tools := []string{"example.com/a/cmd/gen", "example.com/b/gen/v2", "example.com/b/lint", "golang.org/x/tools/cmd/stringer"}
+
+	for name, expected := range map[string]string{
+		"stringer":              "golang.org/x/tools/cmd/stringer",
+		"lint":                  "example.com/b/lint",
+		"example.com/a/cmd/gen": "example.com/a/cmd/gen",
+		"example.com/b/gen/v2":  "example.com/b/gen/v2",
+	} {
+		assert.Equal(t, expected, must.OK1(matchTool(tools, name)), name)
+	}
+
+	_, err := matchTool(tools, "gen")
+	assert.EqualError(t, err, `tool "gen" is ambiguous, use one of: example.com/a/cmd/gen, example.com/b/gen/v2`)
+	_, err = matchTool(tools, "v2")
+	assert.EqualError(t, err, `no tool "v2" in go.mod`)
+}
+
+func TestFindTools(t *testing.T) {
+	wd := must.OK1(os.Getwd())
+	t.Cleanup(func() { must.OK(os.Chdir(wd)) })
+
+	must.OK(os.Chdir(filepath.Join("testdata", "tools")))
+	_, tools, err := findTools(nil, map[string]string{})
+	must.OK(err)
+	assert.Equal(t, []string{"testdata/tools/cmd/greet"}, tools)
+}
+
+func TestLocalToolInputs(t *testing.T) {
+	// The tool is in a module replaced by a local directory, and it is built from the main module
+	inputs := must.OK1(checksumInputsFrom(t.TempDir(), "testdata/replaced-tool", "testdata/replaced-tool/greeter/cmd/greet", nil, map[string]string{}))
+	assert.Equal(t, "example.com/greeter:cmd/greet", inputs.MainPackage)
+	assert.Equal(t, []string{
+		"example.com/greeter:cmd/greet/main.go",
+		"example.com/greeter:go.mod",
+		"testdata/replaced-tool:go.mod",
+	}, slices.Sorted(maps.Keys(inputs.Files)))
+}
+
+func TestModuleToolInputsAreRelocatable(t *testing.T) {
+	env := map[string]string{"GOWORK": must.OK1(filepath.Abs("testdata/workspace/go.work"))}
+	pc := must.OK1(newMainParseContext(must.OK1(filepath.Abs("testdata/workspace/app")), nil, env, nil))
+
+	inputs := must.OK1(moduleToolInputs(t.TempDir(), pc, "example.com/remote/cmd/hello", nil, env))
+	assert.Equal(t, map[string]string{"GOWORK": ":go.work"}, inputs.Env)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/version"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+//
+// Binaries built by different toolchains must not share cache entries even if the sources are identical.
+//
+// Asking 'go' binary for its version is relatively slow, so the answer is memoized on disk, keyed by the
+// path to the binary and its metadata. This keeps the fast path free of subprocesses.
+//
+
+type toolchainInfo struct {
+	GoBinary  string `json:"go"`        // absolute path to 'go' binary from GO or PATH
+	GoVersion string `json:"version"`   // version of that binary
+	Toolchain string `json:"toolchain"` // toolchain selected according to GOTOOLCHAIN and go.mod/go.work
+}
+
+type localToolchain struct {
+	GoVersion        string `json:"version"`
+	GOROOT           string `json:"goroot"`
+	DefaultToolchain string `json:"default_toolchain"` // GOTOOLCHAIN set in $GOROOT/go.env
+}
+
+func goBinary() string {
+	if bin, found := os.LookupEnv("GO"); found {
+		return bin
+	}
+	return "go"
+}
+
+func toolchainMemoDir(userCacheDir string) string {
+	return filepath.Join(userCacheDir, "gr", "toolchain")
+}
+
+// toolchainMemoFile returns the name of the file memoizing the answer of a binary, given the identity of the
+// binary and everything else the answer depends on
+func toolchainMemoFile(userCacheDir string, key ...any) string {
+	memoKey, err := json.Marshal(key)
+	if err != nil {
+		panic(fmt.Errorf("internal error: toolchain memo key is not marshalable: %w", err))
+	}
+	memoKeyHash := sha256.Sum256(memoKey)
+	return filepath.Join(toolchainMemoDir(userCacheDir), hex.EncodeToString(memoKeyHash[:]))
+}
+
+// lookupBinary finds the absolute path to the binary and its metadata
+func lookupBinary(name string) (string, fileStat, error) {
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return "", fileStat{}, err
+	}
+	if bin, err = filepath.Abs(bin); err != nil {
+		return "", fileStat{}, err
+	}
+	stat, err := lookupBinaryStat(bin)
+	if err != nil {
+		return "", fileStat{}, err
+	}
+	return bin, stat, nil
+}
+
+func lookupBinaryStat(bin string) (fileStat, error) {
+	fi, err := os.Stat(bin)
+	if err != nil {
+		return fileStat{}, err
+	}
+	return newFileStat(fi), nil
+}
+
+func lookupLocalToolchain(userCacheDir string) (string, localToolchain, error) {
+	goBin, goStat, err := lookupBinary(goBinary())
+	if err != nil {
+		return "", localToolchain{}, fmt.Errorf("failed to find go binary: %w", err)
+	}
+
+	// GOROOT overrides the location of the standard library used by the binary
+	memoFile := toolchainMemoFile(userCacheDir, goBin, goStat, os.Getenv("GOROOT"))
+
+	var local localToolchain
+	if contents, err := os.ReadFile(memoFile); err == nil && json.Unmarshal(contents, &local) == nil {
+		return goBin, local, nil
+	}
+
+	// Not memoized yet, or memo file is damaged. Ask the binary.
+
+	// GOTOOLCHAIN=local prevents 'go' from switching to another toolchain, and running in the root
+	// directory prevents it from picking up go.mod or go.work
+	envCmd := exec.Command(goBin, "env", "-json", "GOVERSION", "GOROOT")
+	envCmd.Env = append(os.Environ(), "GOTOOLCHAIN=local")
+	envCmd.Dir = "/"
+	envCmd.Stderr = os.Stderr
+	out, err := envCmd.Output()
+	if err != nil {
+		return "", localToolchain{}, fmt.Errorf("failed to query %s for version: %w", goBin, err)
+	}
+
+	var goEnv struct {
+		GOVERSION string
+		GOROOT    string
+	}
+	if err := json.Unmarshal(out, &goEnv); err != nil {
+		return "", localToolchain{}, fmt.Errorf("failed to query %s for version: %w", goBin, err)
+	}
+
+	local = localToolchain{
+		GoVersion: goEnv.GOVERSION,
+		GOROOT:    goEnv.GOROOT,
+	}
+	goEnvDefaults, err := parseGoEnvFile(filepath.Join(goEnv.GOROOT, "go.env"))
+	if err != nil {
+		return "", localToolchain{}, err
+	}
+	local.DefaultToolchain = goEnvDefaults["GOTOOLCHAIN"]
+
+	contents, err := json.Marshal(local)
+	if err != nil {
+		panic(fmt.Errorf("internal error: toolchain information is not marshalable: %w", err))
+	}
+	if err := writeFileAtomically(memoFile, contents); err != nil {
+		return "", localToolchain{}, fmt.Errorf("failed to memoize toolchain information: %w", err)
+	}
+
+	return goBin, local, nil
+}
+
+func writeFileAtomically(fileName string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after successful rename
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// selectToolchain mirrors the toolchain selection done by the go command, see https://go.dev/doc/toolchain
+func selectToolchain(localVersion, gotoolchain, goLine, toolchainLine string) string {
+	// <name>+auto and <name>+path set the minimum toolchain version
+	name, _, hasSuffix := strings.Cut(gotoolchain, "+")
+	switch name {
+	case "local":
+		return localVersion
+	case "", "auto", "path":
+		name = ""
+	default:
+		if !hasSuffix { // Explicit toolchain name
+			return name
+		}
+	}
+
+	// Toolchain switching is done if main module or workspace require newer toolchain
+	candidates := []string{name, toolchainLine}
+	if goLine != "" {
+		candidates = append(candidates, goLineToolchain(goLine))
+	}
+
+	selected := localVersion
+	for _, v := range candidates {
+		if v != "" && v != "default" && version.Compare(v, selected) > 0 {
+			selected = v
+		}
+	}
+	return selected
+}
+
+// goLineToolchain names the toolchain required by a 'go' line. Since Go 1.21 releases are named by their first
+// patch release, so 'go 1.21' requires go1.21.0, while 'go 1.20' requires go1.20.
+func goLineToolchain(goLine string) string {
+	v := "go" + goLine
+	if version.Lang(v) == v && version.Compare(v, "go1.21") >= 0 {
+		return v + ".0"
+	}
+	return v
+}
+
+func resolveToolchain(userCacheDir string, pc *parseContext, compilerEnv map[string]string) (toolchainInfo, error) {
+	goLine, toolchainLine := pc.mainModule.goVersion, pc.mainModule.toolchain
+	if pc.workspace != nil {
+		goLine, toolchainLine = pc.workspace.goVersion, pc.workspace.toolchain
+	}
+	return resolveToolchainFor(userCacheDir, goLine, toolchainLine, compilerEnv)
+}
+
+// resolveToolchainFor resolves the toolchain given the 'go' and 'toolchain' lines of the main module or workspace,
+// empty outside of them
+func resolveToolchainFor(userCacheDir, goLine, toolchainLine string, compilerEnv map[string]string) (toolchainInfo, error) {
+	goBin, local, err := lookupLocalToolchain(userCacheDir)
+	if err != nil {
+		return toolchainInfo{}, err
+	}
+
+	gotoolchain := envOr(compilerEnv, "GOTOOLCHAIN", local.DefaultToolchain)
+
+	return toolchainInfo{
+		GoBinary:  goBin,
+		GoVersion: local.GoVersion,
+		Toolchain: selectToolchain(local.GoVersion, gotoolchain, goLine, toolchainLine),
+	}, nil
+}
+
+// lookupToolchainTags returns the tags set by the selected toolchain. Release tags follow from its version, and
+// goexperiment tags enabled by default are asked from the toolchain itself.
+func lookupToolchainTags(userCacheDir string, toolchain toolchainInfo, compilerEnv map[string]string) (toolchainTags, error) {
+	experiments, err := lookupExperimentTags(userCacheDir, toolchain, compilerEnv)
+	if err != nil {
+		return toolchainTags{}, err
+	}
+	return toolchainTags{ReleaseTags: releaseTags(toolchain.Toolchain), ExperimentTags: experiments}, nil
+}
+
+// releaseTags returns the release tags of a Go version: go1.1 up to the version itself
+func releaseTags(goVersion string) []string {
+	minor, err := strconv.Atoi(strings.TrimPrefix(version.Lang(goVersion), "go1."))
+	if err != nil {
+		return nil
+	}
+	tags := make([]string, 0, minor)
+	for i := 1; i <= minor; i++ {
+		tags = append(tags, fmt.Sprintf("go1.%d", i))
+	}
+	return tags
+}
+
+// lookupExperimentTags asks the selected toolchain for the goexperiment tags it enables by default. The local
+// toolchain is identified by its binary, others by their names, as released toolchains never change.
+//
+// Asking another toolchain downloads it, the same way the build would. If it can't be downloaded, the build
+// fails anyway, so the tags of the local toolchain are good enough, and they are memoized for the other toolchain
+// too, so that it is not asked again on every run.
+func lookupExperimentTags(userCacheDir string, toolchain toolchainInfo, compilerEnv map[string]string) ([]string, error) {
+	// Experiments enabled by default may depend on the target platform
+	goos, goarch := envOr(compilerEnv, "GOOS", runtime.GOOS), envOr(compilerEnv, "GOARCH", runtime.GOARCH)
+
+	var switchedMemoFile string
+	if toolchain.Toolchain != toolchain.GoVersion {
+		switchedMemoFile = toolchainMemoFile(userCacheDir, "experiments", toolchain.Toolchain, goos, goarch)
+		if tags, err := memoizedExperimentTags(switchedMemoFile, toolchain.GoBinary, toolchain.Toolchain, goos, goarch, nil); err == nil {
+			return tags, nil
+		}
+	}
+
+	goStat, err := lookupBinaryStat(toolchain.GoBinary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find go binary: %w", err)
+	}
+	memoFile := toolchainMemoFile(userCacheDir, "experiments", toolchain.GoBinary, goStat, os.Getenv("GOROOT"), goos, goarch)
+	tags, err := memoizedExperimentTags(memoFile, toolchain.GoBinary, "local", goos, goarch, os.Stderr)
+	if err != nil || switchedMemoFile == "" {
+		return tags, err
+	}
+	if err := writeExperimentTags(switchedMemoFile, tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func memoizedExperimentTags(memoFile, goBin, gotoolchain, goos, goarch string, stderr io.Writer) ([]string, error) {
+	var tags []string
+	if contents, err := os.ReadFile(memoFile); err == nil && json.Unmarshal(contents, &tags) == nil {
+		return tags, nil
+	}
+
+	// Running in the root directory prevents 'go' from picking up go.mod or go.work, and the environment is
+	// cleared of everything else that changes the tags
+	listCmd := exec.Command(goBin, "list", "-f", "{{join context.ToolTags \" \"}}", "runtime")
+	listCmd.Env = append(os.Environ(), "GOTOOLCHAIN="+gotoolchain, "GOENV=off", "GOFLAGS=", "GOEXPERIMENT=",
+		"GOOS="+goos, "GOARCH="+goarch)
+	listCmd.Dir = "/"
+	listCmd.Stderr = stderr
+	out, err := listCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s for build tags: %w", goBin, err)
+	}
+
+	tags = []string{}
+	for _, tag := range strings.Fields(string(out)) {
+		if strings.HasPrefix(tag, "goexperiment.") {
+			tags = append(tags, tag)
+		}
+	}
+
+	if err := writeExperimentTags(memoFile, tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func writeExperimentTags(memoFile string, tags []string) error {
+	contents, err := json.Marshal(tags)
+	if err != nil {
+		panic(fmt.Errorf("internal error: toolchain tags are not marshalable: %w", err))
+	}
+	if err := writeFileAtomically(memoFile, contents); err != nil {
+		return fmt.Errorf("failed to memoize toolchain tags: %w", err)
+	}
+	return nil
+}
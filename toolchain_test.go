@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/dottedmag/must"
+)
+
+func TestSelectToolchain(t *testing.T) {
+	for _, tc := range []struct {
+		gotoolchain   string
+		goLine        string
+		toolchainLine string
+		expected      string
+	}{
+		{gotoolchain: "auto", goLine: "1.23", expected: "go1.25.0"},
+		{gotoolchain: "auto", goLine: "1.26", expected: "go1.26.0"},
+		{gotoolchain: "auto", goLine: "1.26rc1", expected: "go1.26rc1"},
+		{gotoolchain: "auto", goLine: "1.23", toolchainLine: "go1.26.2", expected: "go1.26.2"},
+		{gotoolchain: "auto", goLine: "1.23", toolchainLine: "default", expected: "go1.25.0"},
+		{gotoolchain: "path", goLine: "1.26.1", expected: "go1.26.1"},
+		{gotoolchain: "local", goLine: "1.26", toolchainLine: "go1.26.2", expected: "go1.25.0"},
+		{gotoolchain: "go1.24.3", goLine: "1.26", expected: "go1.24.3"},
+		{gotoolchain: "go1.25.5+auto", goLine: "1.23", expected: "go1.25.5"},
+		{gotoolchain: "go1.25.5+auto", goLine: "1.23", toolchainLine: "go1.26.0", expected: "go1.26.0"},
+	} {
+		assert.Equal(t, tc.expected, selectToolchain("go1.25.0", tc.gotoolchain, tc.goLine, tc.toolchainLine))
+	}
+}
+
+func TestGoLineToolchain(t *testing.T) {
+	for goLine, expected := range map[string]string{
+		"1.20":    "go1.20",
+		"1.21":    "go1.21.0",
+		"1.21.3":  "go1.21.3",
+		"1.26rc1": "go1.26rc1",
+	} {
+		assert.Equal(t, expected, goLineToolchain(goLine), goLine)
+	}
+}
+
+func TestLookupExperimentTagsFallbackIsMemoized(t *testing.T) {
+	t.Setenv("GOPROXY", "off")
+	cacheDir := t.TempDir()
+	goBin, local := must.OK2(lookupLocalToolchain(cacheDir))
+	toolchain := toolchainInfo{GoBinary: goBin, GoVersion: local.GoVersion, Toolchain: "go1.999.0"}
+	env := map[string]string{"GOOS": "linux", "GOARCH": "amd64"}
+
+	// The toolchain can't be downloaded, so the tags of the local one are used, and not asked for again
+	tags := must.OK1(lookupExperimentTags(cacheDir, toolchain, env))
+	memoFile := toolchainMemoFile(cacheDir, "experiments", "go1.999.0", "linux", "amd64")
+	assert.Equal(t, tags, must.OK1(memoizedExperimentTags(memoFile, "no-such-go", "go1.999.0", "linux", "amd64", nil)))
+}
+
+func TestLookupLocalToolchainIsMemoized(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	goBin, local := must.OK2(lookupLocalToolchain(cacheDir))
+	assert.NotZero(t, local.GoVersion)
+	assert.NotZero(t, local.GOROOT)
+
+	memos := must.OK1(os.ReadDir(toolchainMemoDir(cacheDir)))
+	assert.Equal(t, 1, len(memos))
+
+	// The second lookup reads the memo instead of asking 'go' binary
+	memoFile := filepath.Join(toolchainMemoDir(cacheDir), memos[0].Name())
+	must.OK(os.WriteFile(memoFile, []byte(`{"version":"go1.0.0-memoized"}`), 0o644))
+
+	goBin2, local2 := must.OK2(lookupLocalToolchain(cacheDir))
+	assert.Equal(t, goBin, goBin2)
+	assert.Equal(t, "go1.0.0-memoized", local2.GoVersion)
+}
+
+func TestReleaseTags(t *testing.T) {
+	assert.Equal(t, []string{"go1.1", "go1.2", "go1.3"}, releaseTags("go1.3.2"))
+	assert.Equal(t, 26, len(releaseTags("go1.26rc1")))
+	assert.Zero(t, releaseTags("devel"))
+}
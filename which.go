@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+//
+// 'gr -which' prints the path to the cached executable instead of running it, building it if needed.
+//
+// The printed entry may be removed by cacheCleanup when the package is rebuilt, or by garbage collection.
+// Callers that keep using it (e.g. debuggers) hold a shared lock on the file (flock(2), or 'flock -s' in
+// shell scripts): locked entries are never removed. To make sure the entry is not removed before the caller
+// locks it, it is marked as the most recently used one, and both cacheCleanup and garbage collection keep
+// recently used entries.
+//
+
+func whichCommand(args []string) int {
+	cli, ok := parseCLI("which", args, nil)
+	if !ok {
+		return 2
+	}
+
+	cp, exitCode := locatePackage(cli)
+	if exitCode != 0 {
+		return exitCode
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(cp.exe, now, now); err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "gr: failed to mark program as used: %v\n", err)
+			return 255
+		}
+		if exitCode := buildPackage(cli, cp); exitCode != 0 {
+			return exitCode
+		}
+	}
+
+	fmt.Println(cp.exe)
+	return 0
+}